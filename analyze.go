@@ -1,134 +1,108 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"path"
-	"strconv"
+	"sort"
 	"strings"
-	"sync/atomic"
 	"time"
 )
 
-func (t *TaskInfo) outFormat(srcLogArr []string) string {
-	var result strings.Builder
+// writeFormat 按输出格式将记录直接写入结果缓冲区，不生成中间字符串
+func (t *TaskInfo) writeFormat(buf *bytes.Buffer, rec *Record) {
 
 	recordA, record4a := "", ""
 	// 处理记录类型
-	if strings.Contains(srcLogArr[11], ":") {
-		record4a = srcLogArr[11]
+	if answer := rec.Field(11); strings.IndexByte(answer, ':') >= 0 {
+		record4a = answer
 	} else {
-		recordA = srcLogArr[11]
+		recordA = answer
 	}
 
 	//特殊处理，不并入主干
 	if t.OutputFormatString == "jituan" {
-		result.WriteString(
-			srcLogArr[4] + "|" +
-				srcLogArr[7] + "|" +
-				srcLogArr[1] + "|" +
-				recordA + "|" +
-				srcLogArr[9] + "|" +
-				srcLogArr[8] + "|" +
-				srcLogArr[10] + "|" +
-				record4a + "|" +
-				srcLogArr[2] + "|" +
-				"0.00" + "|" +
-				srcLogArr[5] + "|" +
-				"320000\n")
-
-		return result.String()
+		for _, field := range [...]string{
+			rec.Field(4),
+			rec.Field(7),
+			rec.Field(1),
+			recordA,
+			rec.Field(9),
+			rec.Field(8),
+			rec.Field(10),
+			record4a,
+			rec.Field(2),
+			"0.00",
+			rec.Field(5),
+		} {
+			buf.WriteString(field)
+			buf.WriteByte('|')
+		}
+		buf.WriteString("320000\n")
+		return
 	}
 
 	for _, i := range t.OutputFormat {
 		//由于DRMS日志中没有区分A、4A日志，所以使用DRMS做数据源又像单独输出A、4A日志的话，需要做特殊处理
 		switch i {
 		case 10017:
-			result.WriteString(recordA + "|")
+			buf.WriteString(recordA)
 		case 10018:
-			result.WriteString(record4a + "|")
+			buf.WriteString(record4a)
+		case outputMatchedName:
+			writeDomains(buf, rec.matchedName(), t.OutputUnicode)
+		case outputRuleCategory, outputRuleSource, outputRuleID:
+			writeRuleMeta(buf, rec, i)
+		case outputRegistrableDomain:
+			writeDomains(buf, registrableDomain(rec.Domain()), t.OutputUnicode)
+		case rec.parser.DomainIndex, rec.parser.CNAMEIndex:
+			writeDomains(buf, rec.Field(i), t.OutputUnicode)
 		default:
-			result.WriteString(srcLogArr[i] + "|")
+			buf.WriteString(rec.Field(i))
 
 		}
+		buf.WriteByte('|')
 
 	}
-	return result.String() + "\n"
+	buf.WriteByte('\n')
 
 }
 
-func (r *MatchRule) domainMatch(domain string) bool {
+func (r *ruleSnapshot) domainMatch(domain string) bool {
 	return r.domainTrie.Search(domain)
 }
 
-func (r *MatchRule) requestIPMatch(ip string) bool {
-
-	switch r.ipFilterMode {
-	case 0:
-		return false
-	case 1:
-		_, OK := r.v4ListMap.Load(ip)
-		return OK
-	case 2:
-		return r.v6Trie.V6Search(ip)
-	case 3:
-		if !strings.Contains(ip, ":") {
-			_, OK := r.v4ListMap.Load(ip)
-			return OK
-		} else {
-			return r.v6Trie.V6Search(ip)
-
-		}
-	default:
-		return false
+// ipMatch 按地址本身判断 v4/v6，只在规则包含该地址族时查找
+func (r *ruleSnapshot) ipMatch(ip string) bool {
+	if strings.IndexByte(ip, ':') < 0 {
+		return r.ipFilterMode&ipModeV4 != 0 && r.v4Ranges.Search(ip)
 	}
+	return r.ipFilterMode&ipModeV6 != 0 && r.v6Trie.Search(ip)
+}
 
+func (r *ruleSnapshot) requestIPMatch(ip string) bool {
+	return r.ipMatch(ip)
 }
 
-func (r *MatchRule) resolveIPMatch(ips string) bool {
-	switch r.ipFilterMode {
-	case 0:
+// resolveIPMatch 响应中的每个地址单独判断，v4/v6 混合的响应也能正确匹配
+func (r *ruleSnapshot) resolveIPMatch(ips string) bool {
+	if r.ipFilterMode == ipModeNone {
 		return false
-	case 1:
-		for _, ip := range strings.Split(ips, ";") {
-			_, OK := r.v4ListMap.Load(ip)
-			if OK {
-				return true
-			}
-		}
-	case 2:
-		for _, ip := range strings.Split(ips, ";") {
-
-			if r.v6Trie.V6Search(ip) {
-				return true
-			}
-		}
-	case 3:
-		if !strings.Contains(ips, ":") {
-			for _, ip := range strings.Split(ips, ";") {
-				_, OK := r.v4ListMap.Load(ip)
-				if OK {
-					return OK
-				}
-			}
-		} else {
-			for _, ip := range strings.Split(ips, ";") {
-
-				if r.v6Trie.V6Search(ip) {
-					return true
-				}
-			}
-
+	}
+	for ip, rest := cutAnswer(ips); ip != "" || rest != ""; ip, rest = cutAnswer(rest) {
+		if r.ipMatch(ip) {
+			return true
 		}
-	default:
-		return false
 	}
-
 	return false
+}
 
+// cutAnswer 取出响应内容中的第一个地址（以 ; 分隔），代替 strings.Split
+func cutAnswer(ips string) (string, string) {
+	ip, rest, _ := strings.Cut(ips, ";")
+	return ip, rest
 }
 
 func (r *MatchRule) Match(IP string, domain string, result string, mode int) bool {
@@ -140,26 +114,32 @@ func (r *MatchRule) Match(IP string, domain string, result string, mode int) boo
 	//11 请求IP+域名
 	//21 解析IP+域名
 
+	snap := r.load()
 	switch mode {
 	case 01:
-		return r.domainMatch(domain)
+		return snap.domainMatch(domain)
 	case 10:
-		return r.requestIPMatch(IP)
+		return snap.requestIPMatch(IP)
 	case 20:
-		return r.resolveIPMatch(IP)
+		return snap.resolveIPMatch(result)
 	case 11:
-		return r.domainMatch(domain) && r.requestIPMatch(IP)
+		return snap.domainMatch(domain) && snap.requestIPMatch(IP)
 	case 21:
-		return r.domainMatch(domain) && r.resolveIPMatch(IP)
+		return snap.domainMatch(domain) && snap.resolveIPMatch(result)
 	default:
 		return false
 	}
 }
 
 func (T *Tasks) genFileName(fileName string) string {
+	return T.genFileNameAt(fileName, time.Now())
+}
+
+// genFileNameAt 使用指定时间生成文件名，按事件时间输出时为窗口起始时间
+func (T *Tasks) genFileNameAt(fileName string, t time.Time) string {
 
 	if fileName == "" {
-		return fmt.Sprintf("%s_%s_%s", "250", T.hostIP, time.Now().Format("20060102150405"))
+		return fmt.Sprintf("%s_%s_%s", "250", T.hostIP, t.Format("20060102150405"))
 	}
 
 	str01 := strings.Split(fileName, "_")
@@ -169,133 +149,221 @@ func (T *Tasks) genFileName(fileName string) string {
 		case "ip":
 			str01[i] = T.hostIP
 		case "time":
-			str01[i] = time.Now().Format("20060102150405")
+			str01[i] = t.Format("20060102150405")
 		}
 
 	}
 	return strings.Join(str01, "_")
 }
 
-func (T *Tasks) filterCounterInitialize() map[string]int {
-	filterMatchCounter := make(map[string]int)
-	for taskName, _ := range T.TaskInfos {
-		filterMatchCounter[taskName] = 0
+// getMainDomain 获取主域名，按公共后缀列表取可注册域名，如 foo.com.cn、x.github.io；
+// 域名本身是公共后缀时返回原域名
+func getMainDomain(domain string) string {
+	if main := registrableDomain(domain); main != "" {
+		return main
 	}
-	return filterMatchCounter
+	return domain
 }
 
-// 获取主域名
-func getMainDomain(domain string) string {
-	//// 使用net/url解析URL
-	//parsedURL, err := url.Parse(domain)
-	//if err != nil {
-	//	return ""
-	//}
-	//
-	//// 获取主机部分
-	//host := parsedURL.Hostname()
-	// 分割主机名
-	//parts := strings.Split(host, ".")
-	parts := strings.Split(domain, ".")
-
-	// 根据主域名规则获取主域名
-	if len(parts) < 2 {
-		return domain // 只有一个部分
+// filterTarget 单个任务在一次分析中的输出目标
+type filterTarget struct {
+	name     string
+	task     *TaskInfo
+	matched  int
+	excluded int
+	// 事件时间任务中响应时间无法解析、未输出的命中记录，不影响其他任务
+	badEventTime int
+
+	// 非事件时间任务的结果
+	buf *bytes.Buffer
+	// 事件时间任务按窗口起始时间划分的结果，以及其中最大的事件时间
+	windowBufs   map[int64]*bytes.Buffer
+	maxEventTime time.Time
+}
+
+// output 返回记录应写入的缓冲区，事件时间任务中响应时间无法解析时返回 nil
+func (t *filterTarget) output(rec *Record) *bytes.Buffer {
+	if t.windowBufs == nil {
+		return t.buf
 	}
 
-	// 返回最后两个部分作为主域名
-	return strings.Join(parts[len(parts)-2:], ".")
+	eventTime, ok := rec.EventTime()
+	if !ok {
+		return nil
+	}
+	if eventTime.After(t.maxEventTime) {
+		t.maxEventTime = eventTime
+	}
+	start := eventWindowStart(eventTime, t.task.EventTimeWindow, rec.parser.eventTime.loc)
+	buf, ok := t.windowBufs[start]
+	if !ok {
+		buf = outBufferPool.Get().(*bytes.Buffer)
+		t.windowBufs[start] = buf
+	}
+	return buf
+}
+
+// filterState 分析一段日志（整个文件或其中一个分块）时的状态，逐行复用，热点路径上不分配内存
+type filterState struct {
+	srcFileName string
+	rec         *Record
+	rejects     *rejectCounter
+	targets     []*filterTarget
+	nums        int
 }
 
-// 读取gz和普通文件
-func (T *Tasks) readFile(fileName string) ([]byte, error) {
-	if strings.HasSuffix(fileName, ".gz") {
-		return UnGzipFile(fileName)
+// taskNames 按名称排序的任务名，分块合并、加锁等需要固定顺序的地方使用
+func (T *Tasks) taskNames() []string {
+	taskNames := make([]string, 0, len(T.TaskInfos))
+	for taskName := range T.TaskInfos {
+		taskNames = append(taskNames, taskName)
 	}
-	return os.ReadFile(fileName)
+	sort.Strings(taskNames)
+	return taskNames
 }
 
-func (T *Tasks) Filter(srcFileName string, taskId int, fileId int) {
+// newFilterState 创建分析状态，结果缓冲区从 outBufferPool 中获取，用完需调用 release 归还
+func (T *Tasks) newFilterState(srcFileName string) *filterState {
+	st := &filterState{
+		srcFileName: srcFileName,
+		rec:         T.parser.NewRecord(),
+		rejects:     T.newRejectCounter(),
+	}
+	// 组合索引中保存了构建时各规则集的快照，取到后不受之后的刷新影响
+	st.rec.index = T.ruleIndex.Load()
+
+	// 各分块的任务顺序必须一致，合并时按下标对应
+	for _, taskName := range T.taskNames() {
+		task := T.TaskInfos[taskName]
+		target := &filterTarget{
+			name: taskName,
+			task: task,
+			buf:  outBufferPool.Get().(*bytes.Buffer),
+		}
+		if task.EventTimeWindow > 0 {
+			target.windowBufs = make(map[int64]*bytes.Buffer)
+		}
+		st.targets = append(st.targets, target)
+	}
+	return st
+}
 
-	if T.IsDelete {
-		defer T.deleteFile(srcFileName)
-	} else {
-		defer T.backupFile(srcFileName)
+// release 归还结果缓冲区
+func (st *filterState) release() {
+	for _, target := range st.targets {
+		target.buf.Reset()
+		outBufferPool.Put(target.buf)
+		for start, buf := range target.windowBufs {
+			buf.Reset()
+			outBufferPool.Put(buf)
+			delete(target.windowBufs, start)
+		}
 	}
+}
 
-	for _, task := range T.TaskInfos {
-		//确认写意图，确保写的线程优先级更高，能够及时拿到锁
-		for {
-			if atomic.LoadInt32(&task.writeFlag) == 1 {
-				time.Sleep(10 * time.Millisecond)
-			} else {
-				break
+// merge 按顺序将分块的结果和统计合并到 st 中
+func (st *filterState) merge(chunk *filterState) {
+	st.nums += chunk.nums
+	st.rejects.merge(chunk.rejects)
+
+	for i, target := range st.targets {
+		src := chunk.targets[i]
+		target.matched += src.matched
+		target.excluded += src.excluded
+		target.badEventTime += src.badEventTime
+		target.buf.Write(src.buf.Bytes())
+		for start, src := range src.windowBufs {
+			buf, ok := target.windowBufs[start]
+			if !ok {
+				buf = outBufferPool.Get().(*bytes.Buffer)
+				target.windowBufs[start] = buf
 			}
+			buf.Write(src.Bytes())
+		}
+		if src.maxEventTime.After(target.maxEventTime) {
+			target.maxEventTime = src.maxEventTime
 		}
-		task.writeLock.RLock()
-		defer task.writeLock.RUnlock()
 	}
+}
 
-	srcLogArr := make([]string, 12)
-	nums := 0
-
-	filterMatchCounter := T.filterCounterInitialize()
+// filterLine 解析并匹配一行日志，结果写入各任务的缓冲区
+func (T *Tasks) filterLine(line []byte, st *filterState) {
+	st.nums++
+	rec := st.rec
 
-	// 读取文件内容
-	TargetContent, err := T.readFile(srcFileName)
-	if err != nil {
-		log.Fatal(err)
+	//剔除异常日志
+	if err := T.parser.Parse(line, rec); err != nil {
+		st.rejects.add(rejectReason(err), st.srcFileName, line)
+		return
+	}
+	if rec.IsQuery() {
+		return
+	}
+	if reason := T.parser.Validate(rec); reason != "" {
+		st.rejects.add(reason, st.srcFileName, line)
 		return
 	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(TargetContent))
-	TargetContent = nil
-
-	start := time.Now()
-
-	//遍历日志文件，匹配域名
-	for scanner.Scan() {
-		nums++
-		copy(srcLogArr, strings.Split(scanner.Text(), "|"))
-
-		//剔除异常日志
-		if len(srcLogArr) < 7 || srcLogArr[0] == "q" {
-			continue
-		}
-
-		//统计每日主域名和访问数量
-		if T.CountDomainMode {
-			if srcLogArr[T.RequestTypeIndex] == "65" {
-				T.DomainCounter.domainIncrement(srcLogArr[T.DomainIndex])
-			}
+	//统计每日主域名和访问数量
+	if T.CountDomainMode {
+		if rec.QType() == "65" {
+			T.DomainCounter.domainIncrement(strings.Clone(getMainDomain(rec.Domain())))
 		}
+	}
 
-		for TaskName, task := range T.TaskInfos {
-
-			if task.taskMatchRule.Match(srcLogArr[T.RequestIPIndex], srcLogArr[T.DomainIndex], srcLogArr[T.ResultIndex], task.FilterTag) {
-				filterMatchCounter[TaskName]++
+	for _, target := range st.targets {
+		task := target.task
 
-				//如果输出标记为full，不处理日志格式直接输出
-				switch task.OutputFormatString {
-				case "full":
-					T.TempResultMap[TaskName+strconv.Itoa(taskId)].WriteString(scanner.Text() + "\n")
+		rec.matched = matchedRule{}
+		if task.matchExpr != nil && task.matchExpr.eval(rec) {
+			//命中后再按排除清单剔除
+			if task.excludeRule != nil && task.excludeRule.excludes(rec) {
+				target.excluded++
+				continue
+			}
+			buf := target.output(rec)
+			if buf == nil {
+				target.badEventTime++
+				continue
+			}
+			target.matched++
 
-				default:
-					T.TempResultMap[TaskName+strconv.Itoa(taskId)].WriteString(task.outFormat(srcLogArr))
+			//如果输出标记为full，不处理日志格式直接输出
+			switch task.OutputFormatString {
+			case "full":
+				buf.Write(line)
+				buf.WriteByte('\n')
 
-				}
+			default:
+				task.writeFormat(buf, rec)
 
 			}
 
 		}
 
 	}
+}
+
+func (T *Tasks) Filter(srcFileName string, taskId int, fileId int) {
+
+	if T.IsDelete {
+		defer T.deleteFile(srcFileName)
+	} else {
+		defer T.backupFile(srcFileName)
+	}
 
-	if err = scanner.Err(); err != nil {
-		log.Println(err)
+	start := time.Now()
+
+	// 按换行切分为多个分块并行分析，结果按分块顺序合并
+	st, err := T.filterChunks(srcFileName)
+	if err != nil {
+		log.Fatal(err)
+		return
 	}
+	defer st.release()
 
-	for TaskName, task := range T.TaskInfos {
+	for _, target := range st.targets {
+		task := target.task
 
 		if _, err = os.Stat(task.OutputDir); os.IsNotExist(err) {
 			// 目录不存在，创建目录
@@ -307,6 +375,11 @@ func (T *Tasks) Filter(srcFileName string, taskId int, fileId int) {
 			log.Println(task.OutputDir, " output dir create successfully")
 		}
 
+		if task.EventTimeWindow > 0 {
+			T.writeEventWindows(target, taskId)
+			continue
+		}
+
 		//记录当前写入文件的信息
 		if task.outPreFileName[taskId] == nil {
 
@@ -322,56 +395,54 @@ func (T *Tasks) Filter(srcFileName string, taskId int, fileId int) {
 		if err == nil {
 
 			if currentFileInfo.Size() >= int64(task.FileMaxSize) || time.Since(task.outPreFileName[taskId].CreateTime) >= task.FileMaxTime {
-				gzFile := strings.TrimSuffix(task.outPreFileName[taskId].fileName, ".tmp")
-				log.Printf("[Rename File] %s to %s\n", task.outPreFileName[taskId].fileName, gzFile)
-				os.Rename(task.outPreFileName[taskId].fileName, gzFile)
-				if task.Upload.IsUpload {
-					err = task.uploadFile(gzFile)
-					if err != nil {
-						log.Println("[Error Upload] failed: %v", err)
-					} else {
-						log.Printf("[Upload] %s to sftp %s successfully\n", gzFile, task.Upload.SFTPHost)
-						T.deleteFile(gzFile)
-
-					}
-				}
+				T.finishOutputFile(task, task.outPreFileName[taskId].fileName)
 				task.outPreFileName[taskId].fileName = path.Join(task.OutputDir, fmt.Sprintf("%s_%s_%s_%d.gz.tmp", "250", T.hostIP, time.Now().Format("20060102150405"), taskId))
 				task.outPreFileName[taskId].CreateTime = time.Now()
 			}
 		}
 
-		if task.IsGzip {
-			T.WriteGzLog(task.outPreFileName[taskId].fileName, T.TempResultMap[TaskName+strconv.Itoa(taskId)])
-		} else {
-			T.WriteLog(task.outPreFileName[taskId].fileName, T.TempResultMap[TaskName+strconv.Itoa(taskId)])
-		}
-		T.TempResultMap[TaskName+strconv.Itoa(taskId)].Reset()
+		T.writeOutput(task, task.outPreFileName[taskId].fileName, target.buf)
 
 	}
 
 	times := time.Since(start)
-	qps := int(float64(nums) / times.Seconds())
+	qps := int(float64(st.nums) / times.Seconds())
 
 	var matchInfo string
 
-	for taskName, matchNum := range filterMatchCounter {
-		matchInfo = matchInfo + fmt.Sprintf("%s: match %d ,", taskName, matchNum)
-	}
 	T.statusLock.Lock()
+	for _, target := range st.targets {
+		matchInfo = matchInfo + fmt.Sprintf("%s: match %d excluded %d ,", target.name, target.matched, target.excluded)
+		if target.badEventTime > 0 {
+			matchInfo = matchInfo + fmt.Sprintf("%s: bad event time %d ,", target.name, target.badEventTime)
+		}
+		T.TaskMatchDetails[target.name] += target.matched
+		if target.excluded > 0 {
+			T.TaskExcludeDetails[target.name] += target.excluded
+		}
+	}
 	T.AnalyzedFileNums++
 	T.statusLock.Unlock()
+	T.recordRejects(srcFileName, st.rejects)
 
-	log.Printf("[Analyze] [taskId threads: %d ,nums: %d] [filename: %s]-[record: %d], [end %s,During: %s, Qps: %d], [%s] \n", taskId, fileId, srcFileName, nums, time.Now().Format("2006-01-02 15:04:05"), times.String(), qps, matchInfo)
+	log.Printf("[Analyze] [taskId threads: %d ,nums: %d] [filename: %s]-[record: %d, rejected: %d], [end %s,During: %s, Qps: %d], [%s] \n", taskId, fileId, srcFileName, st.nums, st.rejects.total, time.Now().Format("2006-01-02 15:04:05"), times.String(), qps, matchInfo)
 
 }
 
 func (T *Tasks) execTransfer() {
-	// 为每个任务和线程初始化缓冲区
-	for i := 0; i < T.AnalyzeThreads; i++ {
-		for taskName := range T.TaskInfos {
-			T.TempResultMap[taskName+strconv.Itoa(i)] = new(bytes.Buffer)
+	// 为每个任务初始化事件时间窗口状态，各线程共享
+	windows := false
+	for _, task := range T.TaskInfos {
+		if task.EventTimeWindow > 0 {
+			task.eventWindows = newEventWindows(task.EventTimeWindow, task.EventTimeLateness, task.EventTimeIdle)
+			windows = true
 		}
+	}
+	if windows {
+		go T.closeIdleEventWindows()
+	}
 
+	for i := 0; i < T.AnalyzeThreads; i++ {
 		T.wg.Add(1)
 		go func(id int) {
 			defer T.wg.Done()
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 默认分块大小
+const defaultChunkSize = 4 << 20
+
+// chunkPool 分块读取缓冲区复用
+var chunkPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// fileChunk 按换行对齐的一段日志
+type fileChunk struct {
+	seq  int
+	data *[]byte
+}
+
+// chunkResult 分块的分析结果
+type chunkResult struct {
+	seq int
+	st  *filterState
+}
+
+// openInput 打开输入文件，gz 文件返回解压流，解压与分析在不同的 goroutine 中流水线执行
+func openInput(fileName string) (io.Reader, func(), error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(fileName, ".gz") {
+		return file, func() { file.Close() }, nil
+	}
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return gzReader, func() {
+		gzReader.Close()
+		file.Close()
+	}, nil
+}
+
+// readChunks 从 r 中读取按换行对齐的分块，最后一个分块可以不以换行结尾。
+// 单行超过分块大小时自动扩容，保证每个分块都只包含完整的行。
+func readChunks(r io.Reader, chunkSize int, chunks chan<- *fileChunk, inflight chan struct{}) error {
+	defer close(chunks)
+
+	var carry []byte
+	for seq := 0; ; seq++ {
+		inflight <- struct{}{}
+
+		data := chunkPool.Get().(*[]byte)
+		buf := append((*data)[:0], carry...)
+		if cap(buf) < chunkSize {
+			buf = append(make([]byte, 0, chunkSize), buf...)
+		}
+
+		var err error
+		for {
+			if len(buf) == cap(buf) {
+				// 整块内没有换行，扩容继续读
+				buf = append(buf, 0)[:len(buf)]
+			}
+			var n int
+			n, err = io.ReadFull(r, buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err != nil || bytes.IndexByte(buf[len(buf)-n:], '\n') >= 0 {
+				break
+			}
+		}
+
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			*data = buf
+			chunkPool.Put(data)
+			<-inflight
+			return err
+		}
+
+		carry = carry[:0]
+		if !eof {
+			cut := bytes.LastIndexByte(buf, '\n') + 1
+			carry = append(carry, buf[cut:]...)
+			buf = buf[:cut]
+		}
+
+		*data = buf
+		if len(buf) == 0 {
+			chunkPool.Put(data)
+			<-inflight
+			return nil
+		}
+		chunks <- &fileChunk{seq: seq, data: data}
+		if eof {
+			return nil
+		}
+	}
+}
+
+// filterChunk 逐行分析一个分块，与 bufio.ScanLines 一致：去掉行尾的 \r，末尾没有换行的最后一行也会处理
+func (T *Tasks) filterChunk(data []byte, st *filterState) {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		T.filterLine(line, st)
+	}
+}
+
+// filterChunks 将文件切分为按换行对齐的分块，由多个 worker 并行分析，
+// 结果按分块顺序合并，保证每个任务的输出顺序与单线程一致。
+func (T *Tasks) filterChunks(srcFileName string) (*filterState, error) {
+	r, closeInput, err := openInput(srcFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+
+	workers := T.SplitWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	chunks := make(chan *fileChunk, workers)
+	results := make(chan chunkResult, workers)
+	// 限制同时在内存中的分块数，慢分块不会导致后续分块无限堆积
+	inflight := make(chan struct{}, workers*2)
+
+	// 整个文件的各分块使用同一份组合索引，分析期间刷新的规则从下一个文件开始生效
+	index := T.ruleIndex.Load()
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readChunks(r, T.splitChunkSize, chunks, inflight)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				st := T.newFilterState(srcFileName)
+				st.rec.index = index
+				T.filterChunk(*chunk.data, st)
+				chunkPool.Put(chunk.data)
+				results <- chunkResult{seq: chunk.seq, st: st}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	st := T.newFilterState(srcFileName)
+	pending := make(map[int]*filterState)
+	next := 0
+	for result := range results {
+		pending[result.seq] = result.st
+		for {
+			chunkSt, ok := pending[next]
+			if !ok {
+				break
+			}
+			st.merge(chunkSt)
+			chunkSt.release()
+			delete(pending, next)
+			next++
+			<-inflight
+		}
+	}
+
+	return st, <-readErr
+}
+
+// merge 合并分块的拒绝统计
+func (rc *rejectCounter) merge(src *rejectCounter) {
+	rc.total += src.total
+	for reason, num := range src.reasons {
+		rc.reasons[reason] += num
+	}
+	if rc.lines != nil && src.lines != nil {
+		rc.lines.Write(src.lines.Bytes())
+	}
+}
+
+// parseSize 解析 200M / 4k / 1G 格式的大小
+func parseSize(size string) int {
+	if size == "" {
+		return 0
+	}
+	unit := size[len(size)-1:]
+	value, err := strconv.Atoi(size[:len(size)-1])
+	if err != nil {
+		return 0
+	}
+	switch strings.ToLower(unit) {
+	case "g":
+		return value * 1 << 30
+	case "m":
+		return value * 1 << 20
+	case "k":
+		return value * 1 << 10
+	}
+	return 0
+}
@@ -226,6 +226,7 @@ func (T *Tasks) offlineWatch() {
 
 	}()
 	T.wg.Wait()
+	T.flushEventWindows()
 }
 
 func (T *Tasks) recoverLatestTempFile() {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// qTypeNames 常用的请求类型助记符
+var qTypeNames = map[string]int{
+	"A":          1,
+	"NS":         2,
+	"CNAME":      5,
+	"SOA":        6,
+	"PTR":        12,
+	"HINFO":      13,
+	"MX":         15,
+	"TXT":        16,
+	"RP":         17,
+	"AFSDB":      18,
+	"SIG":        24,
+	"KEY":        25,
+	"AAAA":       28,
+	"LOC":        29,
+	"SRV":        33,
+	"NAPTR":      35,
+	"KX":         36,
+	"CERT":       37,
+	"DNAME":      39,
+	"OPT":        41,
+	"APL":        42,
+	"DS":         43,
+	"SSHFP":      44,
+	"IPSECKEY":   45,
+	"RRSIG":      46,
+	"NSEC":       47,
+	"DNSKEY":     48,
+	"DHCID":      49,
+	"NSEC3":      50,
+	"NSEC3PARAM": 51,
+	"TLSA":       52,
+	"SMIMEA":     53,
+	"HIP":        55,
+	"CDS":        59,
+	"CDNSKEY":    60,
+	"OPENPGPKEY": 61,
+	"CSYNC":      62,
+	"ZONEMD":     63,
+	"SVCB":       64,
+	"HTTPS":      65,
+	"SPF":        99,
+	"TKEY":       249,
+	"TSIG":       250,
+	"IXFR":       251,
+	"AXFR":       252,
+	"ANY":        255,
+	"URI":        256,
+	"CAA":        257,
+}
+
+// parseQType 解析请求类型，支持数字和助记符（不区分大小写）
+func parseQType(s string) (int, bool) {
+	if code, err := strconv.Atoi(s); err == nil {
+		return code, code > 0 && code <= 65535
+	}
+	code, ok := qTypeNames[strings.ToUpper(s)]
+	return code, ok
+}
+
+// rCodeNames 响应编码助记符
+var rCodeNames = map[string]int{
+	"NOERROR":   0,
+	"FORMERR":   1,
+	"SERVFAIL":  2,
+	"NXDOMAIN":  3,
+	"NOTIMP":    4,
+	"REFUSED":   5,
+	"YXDOMAIN":  6,
+	"YXRRSET":   7,
+	"NXRRSET":   8,
+	"NOTAUTH":   9,
+	"NOTZONE":   10,
+	"BADVERS":   16,
+	"BADKEY":    17,
+	"BADTIME":   18,
+	"BADMODE":   19,
+	"BADNAME":   20,
+	"BADALG":    21,
+	"BADTRUNC":  22,
+	"BADCOOKIE": 23,
+}
+
+// parseRCode 解析响应编码，支持数字和助记符（不区分大小写）
+func parseRCode(s string) (int, bool) {
+	if code, err := strconv.Atoi(s); err == nil {
+		return code, code >= 0 && code <= 4095
+	}
+	code, ok := rCodeNames[strings.ToUpper(s)]
+	return code, ok
+}
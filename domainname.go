@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile 域名规范化使用的 IDNA 配置：按查询方式映射（大小写折叠等），
+// 允许日志和清单中常见的下划线
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.Transitional(false))
+
+// normalizeDomain 规范化域名：去掉末尾的点、转为小写、Unicode 域名转为 punycode。
+// 日志中的域名绝大多数已是小写 ASCII，此时直接返回原字符串，不分配内存
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	upper := false
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if c >= 0x80 {
+			if ascii, err := idnaProfile.ToASCII(domain); err == nil {
+				return ascii
+			}
+			return strings.ToLower(domain)
+		}
+		if 'A' <= c && c <= 'Z' {
+			upper = true
+		}
+	}
+	if upper {
+		return strings.ToLower(domain)
+	}
+	return domain
+}
+
+// domainToUnicode 规范化后将 punycode 转为 Unicode 形式，无法转换时返回原字符串
+func domainToUnicode(domain string) string {
+	if unicode, err := idnaProfile.ToUnicode(normalizeDomain(domain)); err == nil {
+		return unicode
+	}
+	return domain
+}
+
+// writeDomains 输出域名字段，output_unicode 开启时逐个转为 Unicode 形式，cname 链以 ; 分隔。
+// punycode 的 label 都以 xn-- 开头，不含 -- 时原样输出
+func writeDomains(buf *bytes.Buffer, names string, unicode bool) {
+	if !unicode || !strings.Contains(names, "--") {
+		buf.WriteString(names)
+		return
+	}
+	for i, name := range strings.Split(names, ";") {
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+		buf.WriteString(domainToUnicode(name))
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 默认的响应时间格式
+const defaultEventTimeLayout = "2006-01-02 15:04:05"
+
+// outBufferPool 窗口结果缓冲区复用，窗口写出后归还
+var outBufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// eventTimeParser 解析响应时间字段（字段 12）
+type eventTimeParser struct {
+	layout string // Go 时间格式，或 unix / unix_ms / unix_us
+	loc    *time.Location
+}
+
+func newEventTimeParser(layout string, zone string) (*eventTimeParser, error) {
+	p := &eventTimeParser{layout: layout, loc: time.Local}
+	if p.layout == "" {
+		p.layout = defaultEventTimeLayout
+	}
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event_time_zone %s: %v", zone, err)
+		}
+		p.loc = loc
+	}
+	return p, nil
+}
+
+func (p *eventTimeParser) parse(value string) (time.Time, error) {
+	switch p.layout {
+	case "unix", "unix_ms", "unix_us":
+		// 兼容带小数的秒级时间戳，如 1700000000.123
+		if p.layout == "unix" && strings.Contains(value, ".") {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.UnixMilli(int64(f * 1000)).In(p.loc), nil
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch p.layout {
+		case "unix_ms":
+			return time.UnixMilli(n).In(p.loc), nil
+		case "unix_us":
+			return time.UnixMicro(n).In(p.loc), nil
+		}
+		return time.Unix(n, 0).In(p.loc), nil
+	default:
+		return time.ParseInLocation(p.layout, value, p.loc)
+	}
+}
+
+// EventTime 解析后的响应时间，同一条记录只解析一次
+func (r *Record) EventTime() (time.Time, bool) {
+	if !r.eventTimeParsed {
+		r.eventTimeParsed = true
+		r.eventTimeOK = false
+		if r.parser.eventTime != nil && r.parser.ResponseTimeIndex >= 0 {
+			t, err := r.parser.eventTime.parse(r.ResponseTime())
+			if err == nil {
+				r.eventTime, r.eventTimeOK = t, true
+			}
+		}
+	}
+	return r.eventTime, r.eventTimeOK
+}
+
+// eventWindowStart 事件时间所在窗口的起始时间（Unix 秒）。窗口按 event_time_zone 的当地时间对齐，
+// 如东八区的 1 天窗口从当地 0 点开始，而不是 UTC 0 点
+func eventWindowStart(eventTime time.Time, window time.Duration, loc *time.Location) int64 {
+	_, offset := eventTime.In(loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	return eventTime.Add(shift).Truncate(window).Add(-shift).Unix()
+}
+
+// eventWindows 按事件时间窗口切分的输出状态，每个任务一份，由各分析线程共享，
+// 记录是否迟到只取决于全部线程共同推进的 watermark
+type eventWindows struct {
+	window   time.Duration
+	lateness time.Duration
+	idle     time.Duration
+
+	lock sync.Mutex
+	// 已处理记录中最大的事件时间
+	watermark time.Time
+	// 上一次关闭窗口时的 watermark，窗口结束+lateness 不晚于该值即视为已关闭
+	closedWatermark time.Time
+	// 因空闲关闭的最后一个窗口的起始时间，不晚于该值的窗口视为已关闭
+	closedBefore int64
+	// 最近一次写入的时间，超过 idle 没有写入时关闭全部窗口
+	lastWrite time.Time
+	// 正在写入的窗口文件，key 为窗口起始时间和分析线程，各线程写入自己的文件
+	open map[int64]map[int]string
+}
+
+func newEventWindows(window time.Duration, lateness time.Duration, idle time.Duration) *eventWindows {
+	if idle <= 0 {
+		idle = window + lateness
+	}
+	return &eventWindows{
+		window:       window,
+		lateness:     lateness,
+		idle:         idle,
+		closedBefore: math.MinInt64,
+		open:         make(map[int64]map[int]string),
+	}
+}
+
+// closed 判断窗口是否已关闭
+func (w *eventWindows) closed(start int64) bool {
+	return start <= w.closedBefore || !time.Unix(start, 0).Add(w.window+w.lateness).After(w.closedWatermark)
+}
+
+// writeEventWindows 将一个文件的结果写入各窗口文件，再按新的 watermark 关闭已越过的窗口（包括其他线程的文件）。
+// 所属窗口已关闭的记录写入单独的 _late 文件并立即关闭，不会覆盖已输出的窗口文件。
+// 窗口是否关闭只取决于此前写入的结果，与同一文件内各分块的处理顺序无关
+func (T *Tasks) writeEventWindows(target *filterTarget, taskId int) {
+	task := target.task
+	w := task.eventWindows
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for start, buf := range target.windowBufs {
+		if w.closed(start) {
+			fileName := path.Join(task.OutputDir, fmt.Sprintf("%s_%d_late.gz.tmp", T.genFileNameAt(task.OutputFileName, time.Unix(start, 0)), taskId))
+			fileName = uniqueOutputName(fileName)
+			log.Printf("[Late] %d bytes of late records for window %s\n", buf.Len(), time.Unix(start, 0).Format("2006-01-02 15:04:05"))
+			T.writeOutput(task, fileName, buf)
+			T.finishOutputFile(task, fileName)
+			continue
+		}
+
+		files, ok := w.open[start]
+		if !ok {
+			files = make(map[int]string)
+			w.open[start] = files
+		}
+		fileName, ok := files[taskId]
+		if !ok {
+			fileName = path.Join(task.OutputDir, fmt.Sprintf("%s_%d.gz.tmp", T.genFileNameAt(task.OutputFileName, time.Unix(start, 0)), taskId))
+			files[taskId] = fileName
+		}
+		T.writeOutput(task, fileName, buf)
+	}
+
+	if target.maxEventTime.After(w.watermark) {
+		w.watermark = target.maxEventTime
+	}
+	w.closedWatermark = w.watermark
+	w.lastWrite = time.Now()
+	T.closeEventWindows(task, false)
+}
+
+// closeEventWindows 关闭 watermark 已越过的窗口，all 为 true 时关闭全部窗口，之后到达的记录按迟到处理。调用方需持有锁
+func (T *Tasks) closeEventWindows(task *TaskInfo, all bool) {
+	w := task.eventWindows
+	for start, files := range w.open {
+		if !all && !w.closed(start) {
+			continue
+		}
+		if start > w.closedBefore && all {
+			w.closedBefore = start
+		}
+		for _, fileName := range files {
+			T.finishOutputFile(task, fileName)
+		}
+		delete(w.open, start)
+	}
+}
+
+// closeIdleEventWindows 超过 event_time_idle 没有新结果时关闭仍在写入的窗口，
+// 在线模式下输入停止后最后的窗口不会一直保留为 .gz.tmp
+func (T *Tasks) closeIdleEventWindows() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, task := range T.TaskInfos {
+			w := task.eventWindows
+			if w == nil {
+				continue
+			}
+			w.lock.Lock()
+			if len(w.open) > 0 && time.Since(w.lastWrite) >= w.idle {
+				log.Printf("[Window] no new records for %s, closing %d open windows\n", w.idle, len(w.open))
+				T.closeEventWindows(task, true)
+			}
+			w.lock.Unlock()
+		}
+	}
+}
+
+// flushEventWindows 全部分析线程退出后关闭仍在写入的窗口文件，否则这些窗口会一直保留为 .gz.tmp
+func (T *Tasks) flushEventWindows() {
+	for _, task := range T.TaskInfos {
+		if w := task.eventWindows; w != nil {
+			w.lock.Lock()
+			T.closeEventWindows(task, true)
+			w.lock.Unlock()
+		}
+	}
+}
+
+// uniqueOutputName 目标 .gz 已存在时追加序号，避免覆盖已关闭的文件
+func uniqueOutputName(tmpName string) string {
+	base := strings.TrimSuffix(tmpName, ".gz.tmp")
+	name := tmpName
+	for i := 2; fileExists(name) || fileExists(strings.TrimSuffix(name, ".tmp")); i++ {
+		name = fmt.Sprintf("%s_%d.gz.tmp", base, i)
+	}
+	return name
+}
+
+// writeOutput 按任务配置写入结果文件
+func (T *Tasks) writeOutput(task *TaskInfo, fileName string, buf *bytes.Buffer) {
+	if task.IsGzip {
+		T.WriteGzLog(fileName, buf)
+	} else {
+		T.WriteLog(fileName, buf)
+	}
+	buf.Reset()
+}
+
+// finishOutputFile 结束一个 tmp 文件：重命名为 .gz，按需上传
+func (T *Tasks) finishOutputFile(task *TaskInfo, tmpFile string) {
+	if _, err := os.Stat(tmpFile); err != nil {
+		return
+	}
+
+	gzFile := strings.TrimSuffix(tmpFile, ".tmp")
+	log.Printf("[Rename File] %s to %s\n", tmpFile, gzFile)
+	os.Rename(tmpFile, gzFile)
+	if task.Upload.IsUpload {
+		err := task.uploadFile(gzFile)
+		if err != nil {
+			log.Printf("[Error Upload] failed: %v\n", err)
+		} else {
+			log.Printf("[Upload] %s to sftp %s successfully\n", gzFile, task.Upload.SFTPHost)
+			T.deleteFile(gzFile)
+		}
+	}
+}
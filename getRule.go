@@ -2,231 +2,283 @@ package main
 
 import (
 	"bufio"
-	"database/sql"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
-	"log"
+	"net/netip"
 	"os"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// MatchRule 封装 IP 清单的结构体
+// IP 过滤模式，按规则中包含的地址族组合
+const (
+	ipModeNone = 0
+	ipModeV4   = 1
+	ipModeV6   = 2
+	ipModeAll  = ipModeV4 | ipModeV6
+)
+
+// MatchRule 封装 IP 清单的结构体。加载的内容保存在不可变的 ruleSnapshot 中，
+// 刷新时构建新快照后原子替换，分析线程无需加锁，已取到的旧快照在用完前保持有效
 type MatchRule struct {
-	sync.RWMutex               // 读写锁
-	v4ListMap        *sync.Map // IPv4 地址存储
-	v6Trie           *TrieNode // IPv6 地址存储
-	domainTrie       *TrieNode //domain 存储
-	ipRulerFiles     []string  // IP 清单文件列表
-	domainRulerFiles []string  // IP 清单文件列表
-	ipFilterMode     int       // 模式标志
-	fileModTimeMap   map[string]time.Time
+	snap             atomic.Pointer[ruleSnapshot] // 当前快照
+	ipRulerFiles     []string                     // IP 清单文件列表
+	domainRulerFiles []string                     // IP 清单文件列表
+	domainExactMatch bool                         // 不带前缀的域名规则是否仅精确匹配
+	indexBit         int                          // 在组合索引中的编号，-1 表示未加入索引
 }
 
-// 查询并写入 domain 的函数
-func (t *TaskInfo) queryAndWriteDomains(filename string) {
-
-	start := time.Now()
-	// 构造 DSN
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True", t.UmpMysqlUser, decString(t.UmpMysqlPass), t.UmpMysqlHost, t.UmpMysqlPort, t.DbName)
+// ruleSnapshot 规则集某次加载的结果，发布后只读
+type ruleSnapshot struct {
+	v4Ranges        *IPv4Ranges    // IPv4 区间存储
+	v6Trie          *Trie          // IPv6 地址存储（二进制前缀树）
+	domainTrie      *TrieNode      //domain 存储
+	ipFilterMode    int            // 模式标志，见 ipModeV4 / ipModeV6
+	counts          ruleCounts     // 加载的规则数
+	domainFileStats []ruleFileStat // 各域名规则文件的加载统计
+	nextExpiry      time.Time      // 未到期条目中最早的到期时间，到期后需重新加载，零值表示没有
+}
 
-	// 连接数据库
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		log.Printf("数据库连接失败: %v\n", err)
-		return
+// newRuleSnapshot 创建空的快照
+func newRuleSnapshot() *ruleSnapshot {
+	return &ruleSnapshot{
+		v4Ranges:   NewIPv4Ranges(),
+		v6Trie:     NewTrie(),
+		domainTrie: NewTrieNode(),
 	}
-	defer db.Close()
+}
 
-	// 执行查询
-	rows, err := db.Query(t.ForceDomainSql)
-	if err != nil {
-		log.Printf("查询失败: %v\n", err)
-		return
-	}
-	defer rows.Close()
+// load 取当前快照
+func (r *MatchRule) load() *ruleSnapshot {
+	return r.snap.Load()
+}
 
-	// 创建或覆盖文件
-	file, err := os.Create(filename)
-	if err != nil {
-		log.Printf("创建文件失败: %v\n", err)
-		return
+// NewMatchRule 初始化 IPListCache
+func (t *TaskInfo) NewMatchRule(ipListFiles []string, domainListFiles []string) {
+	t.taskMatchRule = newMatchRule(ipListFiles, domainListFiles, t.DomainExactMatch)
+	if len(t.FilterDNSServerRuler) > 0 {
+		t.dnsServerRule = newMatchRule(t.FilterDNSServerRuler, nil, false)
 	}
-	defer file.Close()
-
-	// 创建带缓冲的 Writer（默认缓冲区 4KB，可以自定义如 bufio.NewWriterSize(file, 64*1024)）
-	writer := bufio.NewWriterSize(file, 64*1024)
-	defer writer.Flush()
-
-	// 遍历结果写入文件
-	for rows.Next() {
-		var domain string
-		if err := rows.Scan(&domain); err != nil {
-			log.Printf("读取字段失败: %v\n", err)
-			continue
-		}
-		writer.WriteString(domain + "\n")
+	if len(t.ExcludeIpRuler) > 0 || len(t.ExcludeDomainRuler) > 0 {
+		t.excludeRule = newMatchRule(t.ExcludeIpRuler, t.ExcludeDomainRuler, false)
 	}
-	log.Printf("[query database] 读取数据库完成(%v)，domain 列表已写入 %s\n", time.Since(start), filename)
+	t.RefreshIPList() // 初次加载
 }
 
-func (r *MatchRule) checkFileModTime() bool {
-
-	if len(r.ipRulerFiles) > 0 {
-		for _, file := range r.ipRulerFiles {
-			info, err := os.Stat(file)
-			if err != nil {
-				fmt.Printf("获取文件信息失败: %v\n", err)
-				continue
-			}
-			if lastModTime, ok := r.fileModTimeMap[file]; ok {
-				if info.ModTime() != lastModTime {
-					r.fileModTimeMap[file] = info.ModTime()
-					return true
-				}
-
-			}
-		}
-
+// newMatchRule 创建空的规则集，需调用 reload 加载文件
+func newMatchRule(ipListFiles []string, domainListFiles []string, domainExactMatch bool) *MatchRule {
+	r := &MatchRule{
+		ipRulerFiles:     ipListFiles,
+		domainRulerFiles: domainListFiles,
+		domainExactMatch: domainExactMatch,
+		indexBit:         -1,
 	}
-	return false
+	r.snap.Store(newRuleSnapshot())
+	return r
 }
 
-// NewMatchRule 初始化 IPListCache
-func (t *TaskInfo) NewMatchRule(ipListFiles []string, domainListFiles []string) {
-	t.taskMatchRule = &MatchRule{
-		v4ListMap:        &sync.Map{},
-		v6Trie:           NewTrieNode(),
-		domainTrie:       NewTrieNode(),
-		ipRulerFiles:     ipListFiles,
-		domainRulerFiles: domainListFiles,
+// loadRuleSets 加载 rule_sets 中的命名规则集
+func (T *Tasks) loadRuleSets() {
+	T.ruleSets = make(map[string]*MatchRule, len(T.RuleSets))
+	for name, info := range T.RuleSets {
+		set := newMatchRule(info.IpRuler, info.DomainRuler, info.DomainExactMatch)
+		set.reload()
+		T.ruleSets[name] = set
 	}
-	t.RefreshIPList() // 初次加载
 }
 
 // RefreshIPList 刷新 IP 清单
 func (t *TaskInfo) RefreshIPList() {
+	reload := func() {
+		t.taskMatchRule.reload()
+		if t.dnsServerRule != nil {
+			t.dnsServerRule.reload()
+		}
+		if t.excludeRule != nil {
+			t.excludeRule.reload()
+		}
+	}
+	// 加入组合索引后由 Tasks 加载并重建索引
+	if t.refreshHook != nil {
+		t.refreshHook(reload)
+	} else {
+		reload()
+	}
+}
 
-	//申明写意图
-	atomic.StoreInt32(&t.writeFlag, 1)
-	defer atomic.StoreInt32(&t.writeFlag, 0)
-	//加锁
-	t.writeLock.Lock()
-	defer t.writeLock.Unlock()
-
+// reload 重新读取规则文件，构建新的快照后原子替换，正在分析的记录继续使用旧快照
+func (r *MatchRule) reload() {
 	var (
 		v4Counter     int
 		v6Counter     int
 		domainCounter int
+		ipExpired     int
+		ipInvalid     int
+		nextExpiry    time.Time
 	)
 
-	// 创建新的 sync.Map 和 TrieNode，避免直接修改现有数据
-	newV4ListMap := &sync.Map{}
-	newV6Trie := NewTrieNode()
+	// 创建新的 map 和 TrieNode，避免直接修改现有数据
+	newV4Ranges := NewIPv4Ranges()
+	newV6Trie := NewTrie()
 	newDomainTrie := NewTrieNode()
 
-	if len(t.taskMatchRule.ipRulerFiles) != 0 {
-		// 遍历文件并加载 IP
-		for _, file := range t.taskMatchRule.ipRulerFiles {
-			fileHandle, err := os.Open(file)
-			if err != nil {
-				fmt.Printf("Error opening file %s: %v\n", file, err)
+	// 遍历文件并加载 IP
+	for _, file := range r.ipRulerFiles {
+		fileHandle, err := os.Open(file)
+		if err != nil {
+			fmt.Printf("Error opening file %s: %v\n", file, err)
+			continue
+		}
+
+		expiry := newRuleExpiry(file)
+		scanner := bufio.NewScanner(fileHandle)
+		for lineNum := 1; scanner.Scan(); lineNum++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			line, meta := splitRuleMeta(line, fmt.Sprintf("%s:%d", file, lineNum))
+			switch expiry.check(meta) {
+			case ruleExpired:
+				ipExpired++
+				continue
+			case ruleInvalid:
+				ipInvalid++
 				continue
 			}
-			defer fileHandle.Close()
 
-			scanner := bufio.NewScanner(fileHandle)
-			for scanner.Scan() {
-				line := strings.TrimSpace(scanner.Text())
-				if line == "" {
+			if strings.Contains(line, ":") {
+				if err := newV6Trie.InsertRuleMeta(line, meta); err != nil {
+					fmt.Printf("Error parsing IP format in %s: %v\n", line, err)
 					continue
 				}
-
-				if strings.Contains(line, ":") {
-					newV6Trie.v6Insert(line)
-					v6Counter++
-				} else {
-					ips, err := parseIPFormat(line)
-					if err != nil {
-						fmt.Printf("Error parsing IP format in %s: %v\n", line, err)
-						continue
-					}
-					for _, ip := range ips {
-						newV4ListMap.Store(ip, struct{}{})
-						v4Counter++
-					}
+				v6Counter++
+			} else {
+				if err := newV4Ranges.InsertRuleMeta(line, meta); err != nil {
+					fmt.Printf("Error parsing IP format in %s: %v\n", line, err)
+					continue
 				}
+				v4Counter++
 			}
+		}
 
-			if err := scanner.Err(); err != nil {
-				fmt.Printf("Error reading file %s: %v\n", file, err)
-			}
+		if err := scanner.Err(); err != nil {
+			fmt.Printf("Error reading file %s: %v\n", file, err)
 		}
+		fileHandle.Close()
+		nextExpiry = earlierExpiry(nextExpiry, expiry.next)
 	}
 
-	if len(t.taskMatchRule.domainRulerFiles) != 0 {
-
-		for _, file := range t.taskMatchRule.domainRulerFiles {
-			fileHandle, err := os.Open(file)
-			if err != nil {
-				fmt.Printf("Error opening file %s: %v\n", file, err)
-			}
-			defer fileHandle.Close()
-
-			scanner := bufio.NewScanner(fileHandle)
-			for scanner.Scan() {
-				line := strings.TrimSpace(scanner.Text())
-				if line == "" {
-					continue
-				}
-				newDomainTrie.Insert(line)
-				domainCounter++
-			}
-			if err := scanner.Err(); err != nil {
-				fmt.Printf("Error reading file %s: %v\n", file, err)
-			}
+	var fileStats []ruleFileStat
+	if len(r.domainRulerFiles) != 0 {
+		newDomainTrie, fileStats = domainRuleFilesToTree(r.domainRulerFiles, r.domainExactMatch)
+		for _, stat := range fileStats {
+			domainCounter += stat.Accepted
+			nextExpiry = earlierExpiry(nextExpiry, stat.nextExpiry)
 		}
 	}
 
-	// 更新缓存
-	t.taskMatchRule.v4ListMap = newV4ListMap
-	t.taskMatchRule.v6Trie = newV6Trie
-	t.taskMatchRule.domainTrie = newDomainTrie
-	fmt.Printf("Refreshed %d v4IP and %d v6IP rules from files: %s\n", v4Counter, v6Counter, strings.Join(t.taskMatchRule.ipRulerFiles, ", "))
-	fmt.Printf("Refreshed %d domain rules from files: %s\n", domainCounter, strings.Join(t.taskMatchRule.domainRulerFiles, ", "))
+	newV4Ranges.Compact()
+
+	fmt.Printf("Refreshed %d v4IP and %d v6IP rules (%d expired, %d invalid expiry skipped) from files: %s\n", v4Counter, v6Counter, ipExpired, ipInvalid, strings.Join(r.ipRulerFiles, ", "))
+	fmt.Printf("Refreshed %d domain rules from files: %s\n", domainCounter, strings.Join(r.domainRulerFiles, ", "))
 
 	// 设置 ipFilterMode
-	if v4Counter > 0 && v6Counter > 0 {
-		t.taskMatchRule.ipFilterMode = 3
-	} else if v4Counter > 0 {
-		t.taskMatchRule.ipFilterMode = 2
-	} else if v6Counter > 0 {
-		t.taskMatchRule.ipFilterMode = 1
-	} else {
-		t.taskMatchRule.ipFilterMode = 0
+	mode := ipModeNone
+	if v4Counter > 0 {
+		mode |= ipModeV4
+	}
+	if v6Counter > 0 {
+		mode |= ipModeV6
+	}
+	r.snap.Store(&ruleSnapshot{
+		v4Ranges:        newV4Ranges,
+		v6Trie:          newV6Trie,
+		domainTrie:      newDomainTrie,
+		ipFilterMode:    mode,
+		counts:          ruleCounts{v4: v4Counter, v6: v6Counter, domain: domainCounter},
+		domainFileStats: fileStats,
+		nextExpiry:      nextExpiry,
+	})
+}
+
+// ipMeta 命中的 IP 规则的元数据
+func (r *ruleSnapshot) ipMeta(ip string) *ruleMeta {
+	if strings.IndexByte(ip, ':') < 0 {
+		return r.v4Ranges.lookupMeta(ip)
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	return r.v6Trie.lookupMeta(addr)
+}
+
+// excludes 记录的请求域名或请求IP是否在排除清单中
+func (r *MatchRule) excludes(rec *Record) bool {
+	if r.indexBit >= 0 && rec.index != nil {
+		return rec.indexedBits(indexFieldDomain).has(r.indexBit) || rec.indexedBits(indexFieldClient).has(r.indexBit)
 	}
+	snap := r.load()
+	return snap.domainMatch(rec.Domain()) || snap.requestIPMatch(rec.RequestIP())
+}
+
+// GetListMap 获取当前的 IPv4 区间（只读）
+func (r *MatchRule) GetListMap() *IPv4Ranges {
+	return r.load().v4Ranges
+}
+
+// GetTrie 获取当前的 IPv6 前缀树（只读）
+func (r *MatchRule) GetTrie() *Trie {
+	return r.load().v6Trie
+}
+
+// ruleCounts 规则集中各类规则的条数
+type ruleCounts struct {
+	v4, v6, domain int
+}
+
+func (c ruleCounts) add(o ruleCounts) ruleCounts {
+	return ruleCounts{c.v4 + o.v4, c.v6 + o.v6, c.domain + o.domain}
+}
 
+// GetCounts 获取最近一次加载的规则数
+func (r *MatchRule) GetCounts() ruleCounts {
+	if r == nil {
+		return ruleCounts{}
+	}
+	return r.load().counts
 }
 
-// GetListMap 获取当前的 sync.Map（只读）
-func (r *MatchRule) GetListMap() *sync.Map {
-	r.RLock()
-	defer r.RUnlock()
-	return r.v4ListMap
+// files 规则集引用的全部文件，域名文件去掉格式前缀
+func (r *MatchRule) files() []string {
+	files := append([]string{}, r.ipRulerFiles...)
+	for _, spec := range r.domainRulerFiles {
+		files = append(files, ruleFilePath(spec))
+	}
+	return files
 }
 
-// GetTrie 获取当前的 TrieNode（只读）
-func (r *MatchRule) GetTrie() *TrieNode {
-	r.RLock()
-	defer r.RUnlock()
-	return r.v6Trie
+// GetDomainFileStats 获取各域名规则文件的加载统计
+func (r *MatchRule) GetDomainFileStats() []ruleFileStat {
+	return r.load().domainFileStats
 }
 
 // GetFilterMode 获取当前的 ipFilterMode
 func (r *MatchRule) GetFilterMode() int {
-	r.RLock()
-	defer r.RUnlock()
-	return r.ipFilterMode
+	return r.load().ipFilterMode
+}
+
+// ipModeName IP 过滤模式的名称，用于状态输出
+func ipModeName(mode int) string {
+	switch mode {
+	case ipModeV4:
+		return "v4"
+	case ipModeV6:
+		return "v6"
+	case ipModeAll:
+		return "v4+v6"
+	default:
+		return "none"
+	}
 }
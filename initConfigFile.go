@@ -17,9 +17,16 @@ var initConfigFileCmd = &cobra.Command{
 		content := `
 #eth_name: 业务网卡名称（非流量网卡，仅用于获取本机IP，定义文件名称）
 #analyze_threads： 分析线程数目（建议从小到大调试）
+#split_workers：每个分析线程将单个文件按换行切分后并行分析的 worker 数，默认 1（分块依次分析），输出顺序与单线程一致；总 goroutine 数为 analyze_threads × split_workers，分块最多占用约 analyze_threads × split_workers × 2 × split_chunk_size 内存，文件少而大时可减小 analyze_threads、增大 split_workers
+#split_chunk_size：切分的分块大小，默认 4M
 #input_dir：日志输入目录
-#input_format： 指定输入目录的格式
+#input_format： 指定输入目录的格式，字段数与日志不一致的行会被丢弃
+#input_delimiter：字段分隔符，默认 |
+#input_escape：转义符，为空则不启用转义
+#event_time_layout：响应时间（字段12）格式，Go 时间格式或 unix/unix_ms/unix_us，默认 2006-01-02 15:04:05
+#event_time_zone：响应时间的时区，如 Asia/Shanghai，默认本地时区
 #backup_dir：日志处理完成之后，日志移动的位置，为空则不移动
+#reject_dir：异常日志（字段数错误、IP非法、域名为空、请求类型未知）按天输出的目录，为空则只计数
 #online_mode： 在线分析/离线分析（在线分析只分析增量文件，分析完成会一直等待新文件产生/离线分析仅分析存量文件，分析完成后退出）
 
 eth_name: "en0"
@@ -29,15 +36,67 @@ input_format: "r,12,3,4,1,2,5,6,7,14,19,15,13"
 backup_dir: "./backup"
 online_mode: true
 
+#rule_watch_debounce：规则文件（过滤、排除、DNS服务清单和 rule_sets）变化后自动刷新引用它的任务，期间的多次变化合并为一次，默认 1s
+#  监听文件所在目录，编辑器改名覆盖保存也能生效；文件被删除时保留当前规则，重新创建后再刷新
+#rule_source_interval：规则清单（过滤、排除、DNS服务清单和 rule_sets）可以写 http:// 或 https:// 地址，域名清单可加格式前缀，如 hosts:https://feed.local/hosts.txt；
+#  按该间隔获取，默认 10m。使用 ETag / If-Modified-Since 条件请求，内容有更新时才刷新引用它的任务
+#rule_source_cache_dir：规则源的本地缓存目录，默认 rule_cache。启动时或获取失败时使用上次成功获取的内容，启动时既获取失败又没有缓存则无法启动
+#rule_source_timeout：获取规则源的超时时间，默认 30s
+#rule_source_max_size：单个规则源的大小上限，超出时放弃本次获取并保留当前规则，默认 100M。状态接口的 rule_source_stats 中可以查看各规则源最近一次成功获取的时间和错误
+#public_suffix_file：本地公共后缀列表，用于提取可注册域名（eTLD+1，如 foo.com.cn、x.github.io），默认 public_suffix_list.dat，不存在时使用内置列表
+#  count_domain_mode 按可注册域名计数。可从 publicsuffix.org 下载后执行 update-psl -f public_suffix_list.dat [-o 写入位置] 校验并更新，重启后生效
+#exclude_domain_ruler / exclude_ip_ruler：全局排除清单，对所有任务生效，与任务自身的排除清单合并
+#rule_sets：命名规则集，可在任务的 match 中按名称引用，每个规则集可包含 domain_ruler、ip_ruler 和 domain_exact_match，格式与任务的过滤清单相同
+
 #enable：模块开关（true开启过滤）
 #output_dir：结果文件输出目录
 #outpur_format: 输出格式，有三种（1、jituan:drms转集团日志格式输出；2、full:直接输出源格式；3、自定义字段格式）
+#  自定义字段格式中可以使用 matched_name 输出命中的域名（请求域名或 cname 链中的某一项），如 6,19,matched_name
+#  以及 rule_category、rule_source、rule_id 输出命中规则的元数据，如 6,1,matched_name,rule_category,rule_id
+#  registrable_domain 输出请求域名的可注册域名，如 6,registrable_domain
+#output_unicode：自定义字段格式中的请求域名、cname、matched_name、registrable_domain 以 Unicode 形式输出（如 xn--fiqs8s.cn 输出为 中国.cn），默认原样输出
 #is_gzip：结果文件是否压缩
 #filter_domain_ruler: 域名过滤清单，为空代表不过滤
 #filter_ip_ruler: ip过滤清单，为空代表不过滤
+#  IPv4 支持单个地址、CIDR（如 192.168.0.0/24）和范围（如 192.168.1.1-192.168.1.2），网段不会展开为单个地址
+#  IPv6 支持单个地址（压缩或完整写法、不区分大小写）、CIDR（如 2409:8720:c01:2a::/64）和范围（如 2409:8720::1-2409:8720::3）
 #file_max_size: 不填写默认 200M
 #file_max_time: 不填写默认为9999h，即永不截断
+#event_time_window：按响应时间切分输出文件的窗口大小（如 5m），窗口按 event_time_zone 的当地时间对齐，文件名中的 time 为窗口起始时间，开启后 file_max_size/file_max_time 不生效；响应时间无法解析的记录只在该任务中跳过并计数，不影响其他任务
+#event_time_lateness：窗口关闭前允许的迟到时间，按所有分析线程已处理的最大响应时间判断，窗口关闭后到达的记录写入该窗口的 _late 文件
+#event_time_idle：超过该时间没有新结果时关闭所有仍在写入的窗口，默认为 event_time_window 加 event_time_lateness
 #domain_exact_match：域名精准过滤。默认会将过滤清单中的域名视为泛域名，如果为true则视为精确域名
+#  清单中可以逐行指定匹配方式，不受 domain_exact_match 影响：=a.com 仅匹配 a.com；.a.com 或 *.a.com 仅匹配子域名；a.com 匹配 a.com 及子域名
+#  清单中也可以写通配符或正则：包含 * ? [ 的行（开头的 *. 除外）为通配符，如 ad[0-9]*.*.example.net，需整体匹配；
+#  re:<正则>、/<正则>/ 或以 ^ 开头、以 $ 结尾的行为正则，如 ^[a-z0-9]{30,}\.dyndns\.org$。无法编译的规则会按文件和行号报错并跳过
+#  域名清单支持 hosts（0.0.0.0 evil.com，精确匹配）、AdBlock（||evil.com^，匹配域名及子域名）和 RPZ 区域文件（只取 QNAME 触发器，支持 $ORIGIN、$GENERATE），
+#  按内容自动识别，也可以写成 格式:路径 声明，如 hosts:/data/hosts.txt、adblock:easylist.txt、rpz:db.rpz、list:domain.txt；
+#  加载时按文件输出有效行数和跳过的行数（无法解析或不支持的写法），状态接口的 rule_file_stats 中也可以查看
+#  清单和日志中的域名匹配前统一规范化：不区分大小写、忽略末尾的点，Unicode 域名转为 punycode（如 中国.cn 与 xn--fiqs8s.cn 等价）
+#  域名和IP清单的每行规则后可以附加元数据，如 evil.com,category=c2,source=feedX,id=123；多条规则命中时取最具体的一条
+#  元数据 expires=2026-11-01（可精确到秒或带时区）或 ttl=30d 设置条目的到期时间（hosts、AdBlock、RPZ 文件写在行尾、注释之前，如 0.0.0.0 evil.com,expires=2026-11-01，只识别 category / source / id / expires / ttl），ttl 从清单文件的修改时间起算，改写或 touch 文件会重新计时；规则源的缓存文件和数据库同步的清单每次同步都会改写，其中带 ttl 的条目跳过并计入 skipped，应使用 expires；到期的条目不再命中，最早的条目到期时自动重新加载，无法解析的 expires / ttl 所在的条目跳过并计入 skipped；
+#  数据库规则源可以通过 expires 列设置到期时间；rule-expiry -w 7d 命令列出 7 天内到期和已到期的条目
+#sql_sources：数据库规则源，每项包含 name、driver（mysql / postgres / sqlite）、dsn、password（enc 命令加密，替换 dsn 中的 {password}）、query（仅支持 select）、type（domain / ip，默认 domain）
+#  查询结果的第一列为规则，其余列按列名（category / source / id / expires，可用 AS 指定）写为元数据；同类型的多个规则源合并去重，任一查询失败时保留当前清单
+#sql_domain_list / sql_ip_list：合并后写入的清单文件，默认 sql_任务名_domain.list / sql_任务名_ip.list，自动加入 filter_domain_ruler / filter_ip_ruler
+#sql_update：数据库规则源的同步间隔，默认 1m。force_domain_mode 的配置作为一个 mysql 域名规则源，结果写入 force_domain_list
+#sql_timeout：单次查询（包括读取全部结果）的超时时间，默认 30s，超时或读取中断时保留当前清单。各规则源的连接在多次同步间复用
+#sql_max_shrink：新结果比当前清单减少超过该百分比时不替换清单，默认 50，设为 0 不允许减少，设为 100 不检查。清单先写临时文件再改名替换
+#sql_allow_empty：查询结果为空时也替换清单（仍受 sql_max_shrink 限制），默认 false，结果为空时保留当前清单
+#domain_match_scope：filter_domain_ruler 匹配的对象，qname 请求域名（默认）、cname cname 链中的任一域名、both 两者之一
+#match：匹配表达式，为空时由 filter_domain_ruler / filter_ip_ruler / is_match_resolve_ip 生成
+#  字段：domain 请求域名、cname cname 链中的任一域名、client 请求IP、answer 响应中的任一地址、server DNS服务IP、qtype 请求类型、rcode 响应编码
+#  registrable_domain 请求域名的可注册域名，适合按注册域名整理的清单，如 registrable_domain in new_registered，a.b.foo.com.cn 按 foo.com.cn 查找
+#  条件：字段 in 规则集名，或 字段 in (值1, 值2)；支持 and / or / not 和括号，如
+#  (domain in listA or cname in listA) and client not in internal and qtype in (A, AAAA)
+#  task 表示本任务的 filter_domain_ruler 和 filter_ip_ruler，其余规则集在 rule_sets 中定义
+#filter_qtype：请求类型列表，名称或数字，如 [A, AAAA, 65]，为空代表不过滤
+#filter_rcode：响应编码列表，名称或数字，如 [NXDOMAIN, SERVFAIL]，为空代表不过滤
+#filter_dns_server_ruler：DNS服务IP清单，格式与 filter_ip_ruler 相同，为空代表不过滤
+#  以上三项与 match（或 filter_domain_ruler / filter_ip_ruler）取 and，如 filter_rcode: [NXDOMAIN] 加 filter_dns_server_ruler 可输出某组服务器返回的全部 NXDOMAIN
+#exclude_domain_ruler：排除域名清单，命中后请求域名在清单中的记录不输出，格式与 filter_domain_ruler 相同，随过滤清单一起刷新
+#exclude_ip_ruler：排除IP清单，命中后请求IP在清单中的记录不输出，格式与 filter_ip_ruler 相同
+#  被排除的记录数见状态接口的 task_exclude_details
 
 task_infos:
     apt:
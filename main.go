@@ -1,9 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"database/sql"
+	"net/http"
 	_ "net/http/pprof" // pprof包的init方法会注册5个uri pattern方法到runtime包中
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,18 +24,39 @@ type RunStatus struct {
 	StartTime        string         `json:"start_time"`
 	AnalyzedFileNums int            `json:"analyzed_file_nums"`
 	TaskMatchDetails map[string]int `json:"task_match_details"`
-	statusLock       sync.Mutex
+	//每个任务命中后被排除清单剔除的记录数
+	TaskExcludeDetails map[string]int `json:"task_exclude_details"`
+	//每个任务实际生效的过滤模式
+	TaskFilterModes map[string]taskFilterMode `json:"task_filter_modes"`
+	//各域名规则文件的格式、有效行数和跳过的行数
+	RuleFileStats map[string]ruleFileStat `json:"rule_file_stats"`
+	//各 HTTP(S) 规则源最近一次获取的结果
+	RuleSourceStats map[string]ruleSourceStatus `json:"rule_source_stats"`
+
+	//异常日志统计：总数、按原因、按输入文件+原因
+	RejectedRecords   int                       `json:"rejected_records"`
+	RejectReasons     map[string]int            `json:"reject_reasons"`
+	RejectFileDetails map[string]map[string]int `json:"reject_file_details"`
+	rejectFileOrder   []string
+	statusLock        sync.Mutex
+}
+
+// taskFilterMode 任务实际生效的匹配方式和 IP 过滤模式
+type taskFilterMode struct {
+	Match  string `json:"match"`   // 实际使用的匹配表达式
+	IPMode string `json:"ip_mode"` // none / v4 / v6 / v4+v6，由规则文件中的地址决定
 }
 
 // logIndex 日志字段索引
 type logIndex struct {
-	RequestIPIndex   int //请求IP
-	DNSServerIndex   int //DNS IP
-	RequestTypeIndex int
-	RCodeIndex       int //响应编码
-	DomainIndex      int //请求域名
-	ResultIndex      int //响应结果
-
+	RequestIPIndex    int //请求IP
+	DNSServerIndex    int //DNS IP
+	RequestTypeIndex  int
+	RCodeIndex        int //响应编码
+	DomainIndex       int //请求域名
+	ResultIndex       int //响应结果
+	CNAMEIndex        int //cname
+	ResponseTimeIndex int //响应时间
 }
 
 type Tasks struct {
@@ -47,17 +70,65 @@ type Tasks struct {
 
 	InputDir string `yaml:"input_dir"`
 
-	InputFormat string               `yaml:"input_format"`
-	BackupDir   string               `yaml:"backup_dir"`
-	IsDelete    bool                 `yaml:"is_delete"`
-	TaskInfos   map[string]*TaskInfo `yaml:"task_infos"`
+	InputFormat string `yaml:"input_format"`
+	//字段分隔符，默认 |
+	InputDelimiter string `yaml:"input_delimiter"`
+	//转义符，为空则不启用转义
+	InputEscape string `yaml:"input_escape"`
+	//响应时间格式（Go 时间格式或 unix/unix_ms/unix_us）及时区
+	EventTimeLayout string `yaml:"event_time_layout"`
+	EventTimeZone   string `yaml:"event_time_zone"`
+	parser          *RecordParser
+
+	BackupDir string `yaml:"backup_dir"`
+	//异常日志输出目录，为空则只计数不落盘
+	RejectDir  string `yaml:"reject_dir"`
+	rejectLock sync.Mutex
+
+	IsDelete  bool                 `yaml:"is_delete"`
+	TaskInfos map[string]*TaskInfo `yaml:"task_infos"`
+
+	//全局排除清单，对所有任务生效
+	ExcludeDomainRuler []string `yaml:"exclude_domain_ruler"`
+	ExcludeIpRuler     []string `yaml:"exclude_ip_ruler"`
+
+	//规则文件变化后等待的时间，期间的多次变化合并为一次刷新，默认 1s
+	RuleWatchDebounce time.Duration `yaml:"rule_watch_debounce"`
+
+	//通过 HTTP(S) 获取的规则源，规则清单中的地址替换为 ruleSources 的本地缓存文件
+	RuleSourceInterval      time.Duration `yaml:"rule_source_interval"`
+	RuleSourceTimeout       time.Duration `yaml:"rule_source_timeout"`
+	RuleSourceMaxSizeString string        `yaml:"rule_source_max_size"`
+	RuleSourceCacheDir      string        `yaml:"rule_source_cache_dir"`
+	ruleSources             map[string]*ruleSource
+	ruleSourceClient        *http.Client
+	ruleSourceMaxSize       int64
+
+	//本地公共后缀列表，用于提取可注册域名，默认 public_suffix_list.dat，不存在时使用内置列表
+	PublicSuffixFile string `yaml:"public_suffix_file"`
+
+	//命名规则集，可在任务的 match 表达式中引用
+	RuleSets map[string]*RuleSetInfo `yaml:"rule_sets"`
+	ruleSets map[string]*MatchRule
+
+	//所有任务引用的规则集的组合索引，indexedSets 的下标为规则集编号
+	ruleIndex   atomic.Pointer[ruleIndex]
+	indexedSets []*MatchRule
+	indexLock   sync.Mutex
+	//规则文件变化或条目到期时刷新的对象，见 ruleWatchTargets
+	ruleTargets []*ruleWatchTarget
+	//在最早的条目到期时重新加载，见 scheduleRuleExpiry
+	expiryTimer *time.Timer
+	expiryLock  sync.Mutex
 
 	OnlineMode bool `yaml:"online_mode"`
 	adminMode  bool `yaml:"admin_mode"`
 
-	//analyze模块中，每个任务单独一个buffer，用于存储单个文件的分析结果
-	//此举是模拟了sync.pool方法，杜绝频繁申请内存的行为
-	TempResultMap map[string]*bytes.Buffer
+	//每个分析线程将单个文件切分为多个分块并行分析的 worker 数，默认 1
+	SplitWorkers int `yaml:"split_workers"`
+	//分块大小，默认 4M
+	SplitChunkSizeString string `yaml:"split_chunk_size"`
+	splitChunkSize       int
 
 	//用于离线分析线程的主动终止逻辑
 	wg sync.WaitGroup
@@ -82,6 +153,25 @@ type DomainCounter struct {
 	mu         sync.Mutex     // 保护 merged map
 }
 
+// RuleSetInfo 命名规则集，格式与任务的 filter_domain_ruler / filter_ip_ruler 相同
+type RuleSetInfo struct {
+	DomainRuler      []string `yaml:"domain_ruler"`
+	IpRuler          []string `yaml:"ip_ruler"`
+	DomainExactMatch bool     `yaml:"domain_exact_match"`
+}
+
+// SQLSourceInfo 从数据库查询的规则源。查询结果的第一列为规则（域名或 IP/网段），
+// 其余列按列名写为元数据（category / source / id / expires / ttl，可用 AS 指定）
+type SQLSourceInfo struct {
+	Name     string `yaml:"name"`
+	Driver   string `yaml:"driver"`   // mysql / postgres / sqlite
+	DSN      string `yaml:"dsn"`      // 其中的 {password} 替换为解密后的 password
+	Password string `yaml:"password"` // enc 命令加密后的密码
+	Query    string `yaml:"query"`
+	Type     string `yaml:"type"` // domain / ip
+	db       *sql.DB
+}
+
 type TaskInfo struct {
 	//是否启用
 	Enable bool `yaml:"enable"`
@@ -95,12 +185,15 @@ type TaskInfo struct {
 	//客户端IP
 	FilterIpRuler []string `yaml:"filter_ip_ruler"`
 
-	//ip过滤模式 1-v4 2-v6 3-v4+v6
-	ipFilterMode int
-
 	//请求域名
 	FilterDomainRuler []string `yaml:"filter_domain_ruler"`
 
+	//不带前缀的域名规则仅精确匹配，默认同时匹配子域名
+	DomainExactMatch bool `yaml:"domain_exact_match"`
+
+	//filter_domain_ruler 匹配的对象：qname 请求域名（默认）、cname cname 链中的任一域名、both 两者之一
+	DomainMatchScope string `yaml:"domain_match_scope"`
+
 	//客户端IP
 	IpFilterRuler *sync.Map
 
@@ -114,12 +207,32 @@ type TaskInfo struct {
 	//1:domain only 2:ip only 3:all
 	FilterTag int
 
+	//匹配表达式，如 (domain in listA or cname in listA) and client not in internal and qtype in (A, AAAA)
+	//为空时由 filter_domain_ruler / filter_ip_ruler / is_match_resolve_ip 生成
+	Match       string `yaml:"match"`
+	matchSource string
+	matchExpr   matchExpr
+
+	//请求类型（名称或数字）、响应编码（名称或数字）、DNS服务IP清单，与匹配表达式取 and
+	FilterQType          []string `yaml:"filter_qtype"`
+	FilterRCode          []string `yaml:"filter_rcode"`
+	FilterDNSServerRuler []string `yaml:"filter_dns_server_ruler"`
+	dnsServerRule        *MatchRule
+
+	//排除清单，命中 match 后请求域名或请求IP在清单中的记录不输出，包含全局排除清单
+	ExcludeDomainRuler []string `yaml:"exclude_domain_ruler"`
+	ExcludeIpRuler     []string `yaml:"exclude_ip_ruler"`
+	excludeRule        *MatchRule
+
 	OutputDir      string `yaml:"output_dir"`
 	OutputFileName string `yaml:"output_file_name"`
 
 	OutputFormatString string `yaml:"output_format"`
 	OutputFormat       []int
 
+	//自定义字段格式中的请求域名、cname、matched_name、registrable_domain 以 Unicode 形式输出，默认原样输出（punycode）
+	OutputUnicode bool `yaml:"output_unicode"`
+
 	IsGzip bool `yaml:"is_gzip"`
 
 	FileMaxSizeString string `yaml:"file_max_size"`
@@ -127,6 +240,15 @@ type TaskInfo struct {
 	FileMaxTime       time.Duration `yaml:"file_max_time"`
 	taskMatchRule     *MatchRule
 
+	//按事件时间（响应时间）切分输出文件的窗口大小，为0则按处理时间切分
+	EventTimeWindow time.Duration `yaml:"event_time_window"`
+	//窗口关闭前允许的迟到时间
+	EventTimeLateness time.Duration `yaml:"event_time_lateness"`
+	//超过该时间没有新结果时关闭全部窗口，默认为窗口大小加迟到时间
+	EventTimeIdle time.Duration `yaml:"event_time_idle"`
+	//各分析线程共享的窗口状态
+	eventWindows *eventWindows
+
 	Upload uploadInfo `yaml:"upload"`
 
 	UmpMysqlHost      string        `yaml:"ump_mysql_host"`
@@ -139,9 +261,21 @@ type TaskInfo struct {
 	ForceDomainList   string        `yaml:"force_domain_list"`
 	ForceDomainUpdate time.Duration `yaml:"force_domain_update"`
 
-	//写意图声明,用于数据库更新锁
-	writeFlag int32 // 0: no writer, 1: writer wants lock)
-	writeLock sync.RWMutex
+	//数据库规则源，同类型的多个规则源合并写入 sql_domain_list / sql_ip_list，并加入过滤清单
+	//force_domain_mode 的配置转换为一个 mysql 域名规则源
+	SQLSources    []*SQLSourceInfo `yaml:"sql_sources"`
+	SQLDomainList string           `yaml:"sql_domain_list"`
+	SQLIPList     string           `yaml:"sql_ip_list"`
+	SQLUpdate     time.Duration    `yaml:"sql_update"`
+	//单次查询（含读取结果）的超时时间；新结果比当前清单减少超过 sql_max_shrink（百分比）时不替换，
+	//未配置时为 defaultSQLMaxShrink，配置为 0 时不允许减少；查询结果为空时只有 sql_allow_empty 才替换
+	SQLTimeout    time.Duration `yaml:"sql_timeout"`
+	SQLMaxShrink  *int          `yaml:"sql_max_shrink"`
+	SQLAllowEmpty bool          `yaml:"sql_allow_empty"`
+	sqlMaxShrink  int
+
+	//加入组合索引后，刷新清单时由 Tasks 加载并重建索引
+	refreshHook func(reload func())
 }
 
 type uploadInfo struct {
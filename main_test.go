@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func BenchmarkDomainListToTree(b *testing.B) {
@@ -19,6 +30,1429 @@ func TestDomainListToTree(t *testing.T) {
 	}
 }
 
+func TestDomainRuleSemantics(t *testing.T) {
+	queries := []string{"a.com", "www.a.com", "x.www.a.com", "com", "ba.com", "a.com.cn"}
+
+	cases := []struct {
+		rule         string
+		exactDefault bool
+		expect       []bool // 与 queries 一一对应
+	}{
+		{"=a.com", false, []bool{true, false, false, false, false, false}},
+		{"=a.com", true, []bool{true, false, false, false, false, false}},
+		{".a.com", false, []bool{false, true, true, false, false, false}},
+		{".a.com", true, []bool{false, true, true, false, false, false}},
+		{"*.a.com", false, []bool{false, true, true, false, false, false}},
+		{"*.a.com", true, []bool{false, true, true, false, false, false}},
+		{"a.com", false, []bool{true, true, true, false, false, false}},
+		{"a.com", true, []bool{true, false, false, false, false, false}},
+	}
+
+	for _, c := range cases {
+		tree := NewTrieNode()
+		tree.InsertRule(c.rule, c.exactDefault)
+		for i, query := range queries {
+			if got := tree.Search(query); got != c.expect[i] {
+				t.Errorf("rule %q (exact %v) search %q: expect %v, got %v", c.rule, c.exactDefault, query, c.expect[i], got)
+			}
+		}
+	}
+
+	//同一域名的多条规则合并
+	tree := NewTrieNode()
+	tree.InsertRule("=a.com", false)
+	tree.InsertRule("*.a.com", false)
+	if !tree.Search("a.com") || !tree.Search("www.a.com") {
+		t.Errorf("=a.com and *.a.com should cover apex and subdomains")
+	}
+
+	//父域名的子域名规则覆盖更深的精确规则
+	tree = NewTrieNode()
+	tree.InsertRule(".a.com", false)
+	tree.InsertRule("=www.a.com", false)
+	if !tree.Search("x.www.a.com") || tree.Search("a.com") {
+		t.Errorf("unexpected result for nested rules")
+	}
+}
+
+func TestDomainPatterns(t *testing.T) {
+	ruleFile := t.TempDir() + "/domain.txt"
+	rules := strings.Join([]string{
+		"a.com",
+		"ad[0-9]+.*.example.net",
+		`^[a-z0-9]{30,}\.dyndns\.org$`,
+		"re:(bad",
+		"/tracker[0-9]+\\./",
+	}, "\n")
+	if err := os.WriteFile(ruleFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, counter := domainRulesToTree([]string{ruleFile}, false)
+	if counter != 5 {
+		t.Errorf("expect 5 rules, got %d", counter)
+	}
+	//无法编译的规则被跳过，其余规则合并
+	if tree.patterns == nil || tree.patterns.count != 3 {
+		t.Fatalf("expect 3 compiled patterns, got %+v", tree.patterns)
+	}
+
+	cases := map[string]bool{
+		"www.a.com":                                    true,
+		"ad1.cdn.example.net":                          true,
+		"ad12.cdn.example.net":                         true,
+		"adx.cdn.example.net":                          false,
+		"ad9x.y.z.example.net":                         false,
+		"bd1.cdn.example.net":                          false,
+		"ad1.example.net.cn":                           false,
+		"abcdefghijklmnopqrstuvwxyz0123456.dyndns.org": true,
+		"short.dyndns.org":                             false,
+		"x.tracker12.com":                              true,
+		"tracker.com":                                  false,
+	}
+	for domain, expect := range cases {
+		if got := tree.Search(domain); got != expect {
+			t.Errorf("search %q: expect %v, got %v", domain, expect, got)
+		}
+	}
+
+	//*. 开头的规则仍按子域名处理，不视为通配符
+	if _, ok := parseDomainPattern("*.a.com"); ok {
+		t.Errorf("*.a.com should not be a pattern")
+	}
+	//字符集后的 + 为量词，其他位置的 + 按字面量处理
+	if expr, _ := parseDomainPattern("ad[0-9]+.*.a+b.net"); expr != `^ad[0-9]+\..*\.a\+b\.net$` {
+		t.Errorf("unexpected glob expression %s", expr)
+	}
+
+	//单条规则可以编译，合并后嵌套超过上限时逐个匹配
+	deep := strings.Repeat("(a", 500) + strings.Repeat(")", 500)
+	m := compilePatterns([]domainPattern{{expr: deep, source: "deep"}, {expr: `^x\.tracker[0-9]+\.com$`, source: "tracker"}})
+	if m == nil || m.re != nil || len(m.res) != 2 || m.count != 2 {
+		t.Fatalf("expect one by one matching, got %+v", m)
+	}
+	if !m.Match("x.tracker12.com") || m.Match("tracker.com") || !m.Match(strings.Repeat("a", 500)) {
+		t.Errorf("unexpected result of one by one matching")
+	}
+}
+
+// TestRuleFileFormats hosts、AdBlock、RPZ 文件按内容识别或按前缀声明格式，统计有效和跳过的行
+func TestRuleFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"hosts.txt": "# comment\n127.0.0.1 localhost\n0.0.0.0 evil.com  www.evil.com # inline\n:: bad6.com\n0.0.0.0\n",
+		"easylist.txt": "[Adblock Plus 2.0]\n! comment\n||ads.example^\n||track.example^$important\n" +
+			"@@||good.example^\n||x.example^$third-party\nexample.net##.banner\n||opt.example^$important,domain=a.com\n",
+		"db.rpz": "$TTL 60\n@ IN SOA localhost. root.localhost. (\n 1 3600 600 86400 60 )\n  IN NS localhost.\n" +
+			"malware.test CNAME . ; block\nnote.test CNAME . ; was, expires=2020-01-01\n*.wild.test CNAME .\n32.1.0.0.10.rpz-ip CNAME .\n" +
+			"$GENERATE 1-3 host$.gen.test CNAME .\n$GENERATE 8-10/2 h${0,3,d}.gen.test CNAME .\n$INCLUDE other.rpz\n",
+		"plain.txt": "0.0.0.0 declared.com\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(dir+"/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, stats := domainRuleFilesToTree([]string{dir + "/hosts.txt", dir + "/easylist.txt", dir + "/db.rpz", "list:" + dir + "/plain.txt"}, false)
+	expect := []ruleFileStat{
+		{dir + "/hosts.txt", ruleFormatHosts, 2, 1, 0, time.Time{}},
+		{dir + "/easylist.txt", ruleFormatAdBlock, 2, 4, 0, time.Time{}},
+		{dir + "/db.rpz", ruleFormatRPZ, 5, 2, 0, time.Time{}},
+		{dir + "/plain.txt", ruleFormatList, 1, 0, 0, time.Time{}},
+	}
+	if len(stats) != len(expect) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	for i := range expect {
+		if stats[i] != expect[i] {
+			t.Errorf("expect %+v, got %+v", expect[i], stats[i])
+		}
+	}
+
+	for domain, want := range map[string]bool{
+		"evil.com":        true,
+		"a.evil.com":      false, // hosts 精确匹配
+		"bad6.com":        true,
+		"localhost":       false,
+		"ads.example":     true,
+		"a.track.example": true,
+		"good.example":    false,
+		"x.example":       false,
+		"opt.example":     false, // domain= 选项不是元数据
+		"note.test":       true,  // 注释中的 k=v 不是元数据
+		"malware.test":    true,
+		"a.wild.test":     true,
+		"wild.test":       false,
+		"host2.gen.test":  true,
+		"h008.gen.test":   true,
+		"h010.gen.test":   true,
+		"h009.gen.test":   false,
+	} {
+		if got := tree.Search(domain); got != want {
+			t.Errorf("search %s: expect %v, got %v", domain, want, got)
+		}
+	}
+}
+
+func TestV6Trie(t *testing.T) {
+	trie := NewTrie()
+	for _, rule := range []string{
+		"2409:8720:0C01:2A::/64",
+		"2409:8720:0c01:2B::1-2409:8720:0c01:2B::3",
+		"2409:8720:0c01:2B::5",
+		"2001:db8::ff-2001:db8::1:1",
+	} {
+		if err := trie.InsertRule(rule); err != nil {
+			t.Fatalf("insert %s: %v", rule, err)
+		}
+	}
+	for _, rule := range []string{"2409::1/129", "1.1.1.1", "a::3-a::1", "xyz"} {
+		if err := trie.InsertRule(rule); err == nil {
+			t.Errorf("insert %s: expect error", rule)
+		}
+	}
+
+	cases := map[string]bool{
+		"2409:8720:c01:2a::1":                     true,
+		"2409:8720:0C01:002A:FFFF:FFFF:FFFF:FFFF": true,
+		"2409:8720:c01:2b::":                      false,
+		"2409:8720:c01:2b::1":                     true,
+		"2409:8720:0c01:002b:0000:0000:0000:0003": true,
+		"2409:8720:c01:2b::4":                     false,
+		"2409:8720:C01:2B::5":                     true,
+		"2001:db8::fe":                            false,
+		"2001:db8::ff":                            true,
+		"2001:db8::ffff":                          true,
+		"2001:db8::1:0":                           true,
+		"2001:db8::1:1":                           true,
+		"2001:db8::1:2":                           false,
+		"1.1.1.1":                                 false,
+		"bad":                                     false,
+	}
+	for ip, expect := range cases {
+		if got := trie.Search(ip); got != expect {
+			t.Errorf("search %s: expect %v, got %v", ip, expect, got)
+		}
+	}
+}
+
+func TestIPv4Ranges(t *testing.T) {
+	ranges := NewIPv4Ranges()
+	for _, rule := range []string{
+		"223.104.149.247",
+		"192.168.0.1/24",
+		"192.168.1.1-192.168.1.2",
+		"192.168.1.3-192.168.1.5", // 与上一条相邻，合并
+		"10.0.0.0/8",
+		"10.1.0.0/16", // 被 10.0.0.0/8 覆盖
+		"255.255.255.255",
+	} {
+		if err := ranges.InsertRule(rule); err != nil {
+			t.Fatalf("insert %s: %v", rule, err)
+		}
+	}
+	for _, rule := range []string{"1.1.1.1/33", "1.1.1.2-1.1.1.1", "::1", "1.1.1"} {
+		if err := ranges.InsertRule(rule); err == nil {
+			t.Errorf("insert %s: expect error", rule)
+		}
+	}
+	ranges.Compact()
+	if ranges.Len() != 5 {
+		t.Errorf("expect 5 merged ranges, got %d: %+v", ranges.Len(), ranges.ranges)
+	}
+
+	cases := map[string]bool{
+		"223.104.149.247": true,
+		"223.104.149.248": false,
+		"192.168.0.0":     true,
+		"192.168.0.255":   true,
+		"192.168.1.0":     false,
+		"192.168.1.1":     true,
+		"192.168.1.5":     true,
+		"192.168.1.6":     false,
+		"10.255.255.255":  true,
+		"11.0.0.0":        false,
+		"255.255.255.255": true,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"bad":             false,
+	}
+	for ip, expect := range cases {
+		if got := ranges.Search(ip); got != expect {
+			t.Errorf("search %s: expect %v, got %v", ip, expect, got)
+		}
+	}
+
+	all := NewIPv4Ranges()
+	all.InsertRule("0.0.0.0/0")
+	all.Compact()
+	if !all.Search("0.0.0.0") || !all.Search("255.255.255.255") {
+		t.Errorf("0.0.0.0/0 should match every address")
+	}
+}
+
+// TestIPFilterModes 各 IP 过滤模式及 v4/v6 混合响应的匹配
+func TestIPFilterModes(t *testing.T) {
+	dir := t.TempDir()
+	v4Rules := writeRuleFile(t, dir, "v4.list", "10.1.1.0/24")
+	v6Rules := writeRuleFile(t, dir, "v6.list", "2409:8720::/32")
+	allRules := writeRuleFile(t, dir, "all.list", "10.1.1.0/24", "2409:8720::/32")
+	domainRules := writeRuleFile(t, dir, "domain.list", "a.com")
+
+	const (
+		v4     = "10.1.1.1"
+		v6     = "2409:8720::1"
+		other4 = "10.9.9.9"
+		other6 = "2001:db8::1"
+	)
+
+	cases := []struct {
+		ipRules  []string
+		mode     int
+		filter   int
+		ip       string
+		domain   string
+		result   string
+		expected bool
+	}{
+		//仅 v4 规则
+		{v4Rules, ipModeV4, 10, v4, "", "", true},
+		{v4Rules, ipModeV4, 10, v6, "", "", false},
+		{v4Rules, ipModeV4, 20, other4, "", other6 + ";" + v4, true},
+		{v4Rules, ipModeV4, 20, v4, "", other4, false},
+		//仅 v6 规则
+		{v6Rules, ipModeV6, 10, v6, "", "", true},
+		{v6Rules, ipModeV6, 10, v4, "", "", false},
+		{v6Rules, ipModeV6, 20, other4, "", v4 + ";" + v6, true},
+		{v6Rules, ipModeV6, 20, v6, "", other6, false},
+		//v4 + v6 规则，混合响应逐个判断
+		{allRules, ipModeAll, 10, v4, "", "", true},
+		{allRules, ipModeAll, 10, v6, "", "", true},
+		{allRules, ipModeAll, 10, other6, "", "", false},
+		{allRules, ipModeAll, 20, other4, "", other4 + ";" + v6, true},
+		{allRules, ipModeAll, 20, other4, "", other6 + ";" + v4, true},
+		{allRules, ipModeAll, 20, v4, "", other6 + ";" + other4, false},
+		//域名 + IP
+		{allRules, ipModeAll, 11, v6, "www.a.com", "", true},
+		{allRules, ipModeAll, 11, v6, "b.com", "", false},
+		{allRules, ipModeAll, 21, other4, "a.com", other4 + ";" + v4, true},
+		{allRules, ipModeAll, 21, v4, "a.com", other4, false},
+		//无 IP 规则
+		{nil, ipModeNone, 01, v4, "a.com", v4, true},
+		{nil, ipModeNone, 10, v4, "a.com", v4, false},
+	}
+
+	for i, c := range cases {
+		task := &TaskInfo{}
+		task.NewMatchRule(c.ipRules, domainRules)
+		if got := task.taskMatchRule.GetFilterMode(); got != c.mode {
+			t.Errorf("case %d: expect ip mode %s, got %s", i, ipModeName(c.mode), ipModeName(got))
+		}
+		if got := task.taskMatchRule.Match(c.ip, c.domain, c.result, c.filter); got != c.expected {
+			t.Errorf("case %d: Match(%q, %q, %q, %d) expect %v, got %v", i, c.ip, c.domain, c.result, c.filter, c.expected, got)
+		}
+	}
+}
+
+func TestMatchExpr(t *testing.T) {
+	parser, err := newRecordParser(benchInputFormat, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := parser.NewRecord()
+	record := func(client, qtype, domain, cname, answer string) *Record {
+		line := fmt.Sprintf("r|2024-01-01 00:00:00|10.0.0.1|53|%s|5353|1|%s|%s|0|%s|%s|3", client, domain, qtype, cname, answer)
+		if err := parser.Parse([]byte(line), rec); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	listA := newMatchRule(nil, nil, false)
+	listA.load().domainTrie.Insert("evil.com")
+	internal := newMatchRule(nil, nil, false)
+	internal.load().v4Ranges.InsertRule("192.168.0.0/16")
+	internal.load().v4Ranges.Compact()
+	internal.load().ipFilterMode = ipModeV4
+	sets := map[string]*MatchRule{"listA": listA, "internal": internal}
+
+	expr, err := parseMatchExpr("(domain in listA or cname in listA) and client not in internal and qtype in (A, AAAA)", sets, parser.logIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		client, qtype, domain, cname string
+		expect                       bool
+	}{
+		{"10.0.0.1", "1", "www.evil.com", "", true},
+		{"10.0.0.1", "28", "cdn.com", "x.cdn.com;evil.com", true},
+		{"10.0.0.1", "1", "good.com", "x.good.com", false},
+		{"192.168.1.1", "1", "www.evil.com", "", false},
+		{"10.0.0.1", "16", "www.evil.com", "", false},
+	}
+	for i, c := range cases {
+		if got := expr.eval(record(c.client, c.qtype, c.domain, c.cname, "")); got != c.expect {
+			t.Errorf("case %d: expect %v, got %v", i, c.expect, got)
+		}
+	}
+
+	//行内取值列表
+	expr, err = parseMatchExpr("NOT domain in (=a.com, .b.com) AND answer in (1.1.1.0/24, 2409::/16)", sets, parser.logIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expr.eval(record("10.0.0.1", "1", "b.com", "", "2.2.2.2;2409::1")) {
+		t.Errorf("inline lists should match")
+	}
+	if expr.eval(record("10.0.0.1", "1", "a.com", "", "1.1.1.1")) {
+		t.Errorf("excluded domain should not match")
+	}
+
+	for _, bad := range []string{
+		"domain in",
+		"domain in unknown",
+		"ttl in (1)",
+		"qtype in listA",
+		"qtype in (A, BOGUS)",
+		"(domain in listA",
+		"domain in listA client in internal",
+	} {
+		if _, err := parseMatchExpr(bad, sets, parser.logIndex); err == nil {
+			t.Errorf("expect error for %q", bad)
+		}
+	}
+
+	//旧配置映射到表达式
+	task := &TaskInfo{FilterTag: 21}
+	task.taskMatchRule = listA
+	if err := task.compileMatch(nil, parser.logIndex); err != nil || task.matchSource != "domain in task and answer in task" {
+		t.Errorf("unexpected legacy match %q: %v", task.matchSource, err)
+	}
+}
+
+// TestTaskFilterConditions filter_qtype / filter_rcode / filter_dns_server_ruler 与匹配表达式取 and
+func TestTaskFilterConditions(t *testing.T) {
+	parser, err := newRecordParser(benchInputFormat, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := parser.NewRecord()
+	record := func(server, qtype, rcode string) *Record {
+		line := fmt.Sprintf("r|2024-01-01 00:00:00|%s|53|192.168.0.1|5353|1|www.a.com|%s|%s||1.1.1.1|3", server, qtype, rcode)
+		if err := parser.Parse([]byte(line), rec); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	serverFile := t.TempDir() + "/pool_b.txt"
+	if err := os.WriteFile(serverFile, []byte("10.0.0.0/24\n2409:8720::53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	//所有由 pool B 返回的 NXDOMAIN
+	task := &TaskInfo{FilterRCode: []string{"NXDOMAIN", "servfail"}, FilterDNSServerRuler: []string{serverFile}}
+	task.NewMatchRule(nil, nil)
+	if err := task.compileMatch(nil, parser.logIndex); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		server, qtype, rcode string
+		expect               bool
+	}{
+		{"10.0.0.1", "1", "3", true},
+		{"10.0.0.1", "1", "NXDOMAIN", true},
+		{"2409:8720::53", "28", "2", true},
+		{"10.0.0.1", "1", "0", false},
+		{"10.0.1.1", "1", "3", false},
+	}
+	for i, c := range cases {
+		if got := task.matchExpr.eval(record(c.server, c.qtype, c.rcode)); got != c.expect {
+			t.Errorf("case %d: expect %v, got %v (%s)", i, c.expect, got, task.matchSource)
+		}
+	}
+
+	//与域名规则、qtype 组合
+	task = &TaskInfo{Match: "domain in (a.com)", FilterQType: []string{"AAAA", "65"}}
+	task.NewMatchRule(nil, nil)
+	if err := task.compileMatch(nil, parser.logIndex); err != nil {
+		t.Fatal(err)
+	}
+	if !task.matchExpr.eval(record("10.0.0.1", "65", "0")) || task.matchExpr.eval(record("10.0.0.1", "1", "0")) {
+		t.Errorf("unexpected result for %s", task.matchSource)
+	}
+
+	task = &TaskInfo{FilterRCode: []string{"NOSUCHCODE"}}
+	task.NewMatchRule(nil, nil)
+	if err := task.compileMatch(nil, parser.logIndex); err == nil {
+		t.Errorf("expect error for unknown rcode")
+	}
+}
+
+// TestExcludeRules 排除清单在命中之后生效，并单独计数
+func TestExcludeRules(t *testing.T) {
+	dir := t.TempDir()
+	task := &TaskInfo{
+		FilterDomainRuler:  writeRuleFile(t, dir, "domain.list", "a.com"),
+		ExcludeDomainRuler: writeRuleFile(t, dir, "exclude_domain.list", "cdn.a.com"),
+		ExcludeIpRuler:     writeRuleFile(t, dir, "exclude_ip.list", "192.168.9.0/24"),
+		OutputFormatString: "full",
+	}
+	tasks := newTestTasks(t, map[string]*TaskInfo{"exclude": task}, nil)
+	st := tasks.newFilterState("exclude")
+	defer st.release()
+
+	for _, c := range []struct{ client, domain string }{
+		{"192.168.0.1", "www.a.com"},   // 命中
+		{"192.168.0.1", "x.cdn.a.com"}, // 域名被排除
+		{"192.168.9.10", "www.a.com"},  // 请求IP被排除
+		{"192.168.9.10", "www.b.com"},  // 未命中，不计入排除
+		{"192.168.0.1", "a.com"},       // 命中
+	} {
+		line := fmt.Sprintf("r|2024-01-01 00:00:00|10.0.0.1|53|%s|5353|1|%s|1|0||1.1.1.1|3", c.client, c.domain)
+		tasks.filterLine([]byte(line), st)
+	}
+
+	if target := st.targets[0]; target.matched != 2 || target.excluded != 2 {
+		t.Errorf("expect 2 matched and 2 excluded, got %d and %d", target.matched, target.excluded)
+	}
+}
+
+// TestRuleWatch 规则文件改名覆盖（编辑器保存）后自动刷新引用它的任务，未引用的任务不刷新
+func TestRuleWatch(t *testing.T) {
+	dir := t.TempDir()
+	domainRules := writeRuleFile(t, dir, "domain.list", "a.com")
+	domainFile := domainRules[0]
+
+	tasks := newTestTasks(t, map[string]*TaskInfo{
+		//不存在的清单和无法监听的目录不影响其他清单的刷新
+		"watched": {FilterDomainRuler: append(domainRules, dir+"/missing.list", dir+"/nodir/x.list")},
+		"other":   {FilterDomainRuler: writeRuleFile(t, dir, "other.list", "x.com")},
+	}, nil)
+	tasks.RuleWatchDebounce = 50 * time.Millisecond
+	otherSnap := tasks.TaskInfos["other"].taskMatchRule.load()
+
+	stop, err := tasks.watchRuleFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	//先写临时文件再改名覆盖
+	if err := os.WriteFile(domainFile+".swp", []byte("a.com\nb.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(domainFile+".swp", domainFile); err != nil {
+		t.Fatal(err)
+	}
+	//规则源更新缓存时与文件监听同时触发刷新（配合 go test -race）
+	for i := 0; i < 10; i++ {
+		go tasks.ruleFileChanged(domainFile)
+	}
+
+	watched := tasks.TaskInfos["watched"]
+	matched := func() bool {
+		return watched.taskMatchRule.load().domainMatch("b.com")
+	}
+	for deadline := time.Now().Add(5 * time.Second); !matched(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("rule file change was not picked up")
+		}
+	}
+
+	if tasks.TaskInfos["other"].taskMatchRule.load() != otherSnap {
+		t.Errorf("unrelated task should not be refreshed")
+	}
+}
+
+// TestDomainMatchScope 域名规则匹配 cname 链，并输出命中的域名
+func TestDomainMatchScope(t *testing.T) {
+	domainRules := writeRuleFile(t, t.TempDir(), "domain.list", "evil.com")
+	lines := []string{
+		"r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|www.evil.com|1|0||1.1.1.1|3",
+		"r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|www.good.com|1|0|good.cdn.com;x.evil.com|1.1.1.1|3",
+		"r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|www.good.com|1|0|good.cdn.com|1.1.1.1|3",
+	}
+
+	for scope, expect := range map[string]string{
+		"":      "www.evil.com|www.evil.com|\n",
+		"cname": "www.good.com|x.evil.com|\n",
+		"both":  "www.evil.com|www.evil.com|\nwww.good.com|x.evil.com|\n",
+	} {
+		task := &TaskInfo{FilterDomainRuler: domainRules, DomainMatchScope: scope}
+		task.OutputFormat = transferFormat(benchInputFormat, "6,matched_name")
+		tasks := newTestTasks(t, map[string]*TaskInfo{"cname": task}, nil)
+		st := tasks.newFilterState("cname")
+		for _, line := range lines {
+			tasks.filterLine([]byte(line), st)
+		}
+		if got := st.targets[0].buf.String(); got != expect {
+			t.Errorf("scope %q: expect %q, got %q", scope, expect, got)
+		}
+		st.release()
+	}
+
+	task := &TaskInfo{DomainMatchScope: "answer"}
+	if err := task.compileMatch(nil, logIndex{}); err == nil {
+		t.Errorf("expect error for invalid domain_match_scope")
+	}
+}
+
+// TestRuleMeta 规则元数据的加载和输出
+func TestRuleMeta(t *testing.T) {
+	dir := t.TempDir()
+	task := &TaskInfo{
+		Match: "domain in task or answer in task",
+		FilterDomainRuler: writeRuleFile(t, dir, "domain.list",
+			"evil.com,category=c2,source=feedX,id=123",
+			"=www.evil.com,category=phishing,id=124",
+			`^[a-z0-9]{30,}\.dyndns\.org$,category=dga,source=feedY`,
+			"plain.com",
+		),
+		FilterIpRuler: writeRuleFile(t, dir, "ip.list",
+			"10.0.0.0/8,category=internal",
+			"10.1.1.0/24,category=scanner,id=9",
+			"2409:8720::/32,category=v6net",
+		),
+		OutputFormat: transferFormat(benchInputFormat, "6,matched_name,rule_category,rule_source,rule_id"),
+	}
+	tasks := newTestTasks(t, map[string]*TaskInfo{"meta": task}, nil)
+
+	cases := map[string]string{
+		"a.evil.com|1.1.1.1":   "a.evil.com|a.evil.com|c2|feedX|123|\n",
+		"www.evil.com|1.1.1.1": "www.evil.com|www.evil.com|phishing||124|\n",
+		"abcdefghijklmnopqrstuvwxyz0123456.dyndns.org|1.1.1.1": "abcdefghijklmnopqrstuvwxyz0123456.dyndns.org|abcdefghijklmnopqrstuvwxyz0123456.dyndns.org|dga|feedY||\n",
+		"x.plain.com|1.1.1.1":       "x.plain.com|x.plain.com||||\n",
+		"good.com|8.8.8.8;10.1.1.7": "good.com||scanner||9|\n",
+		"good.com|10.2.0.1":         "good.com||internal|||\n",
+		"good.com|2409:8720::1":     "good.com||v6net|||\n",
+		"good.com|8.8.8.8":          "",
+	}
+	for in, expect := range cases {
+		domain, answer, _ := strings.Cut(in, "|")
+		st := tasks.newFilterState("meta")
+		line := fmt.Sprintf("r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|%s|1|0||%s|3", domain, answer)
+		tasks.filterLine([]byte(line), st)
+		if got := st.targets[0].buf.String(); got != expect {
+			t.Errorf("%s: expect %q, got %q", in, expect, got)
+		}
+		st.release()
+	}
+
+	//正则中的逗号不会被当作元数据分隔符
+	if rule, meta := splitRuleMeta(`^a{2,3}\.com$`, "test"); rule != `^a{2,3}\.com$` || meta != nil {
+		t.Errorf("unexpected split: %q %+v", rule, meta)
+	}
+}
+
+// TestRegistrableDomain 按公共后缀列表提取可注册域名，本地列表支持通配和例外规则
+func TestRegistrableDomain(t *testing.T) {
+	for domain, expect := range map[string]string{
+		"www.foo.com.cn":   "foo.com.cn",
+		"a.b.x.github.io":  "x.github.io",
+		"www.example.com":  "example.com",
+		"example.com":      "example.com",
+		"com.cn":           "",
+		"host.unknown-tld": "host.unknown-tld",
+	} {
+		if got := registrableDomain(domain); got != expect {
+			t.Errorf("built-in %s: expect %q, got %q", domain, expect, got)
+		}
+	}
+
+	list, err := parseSuffixList(strings.NewReader("// comment\ncom\ncom.cn\n*.ck\n!www.ck\n公司.cn\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicSuffixes = list
+	defer func() { publicSuffixes = nil }()
+	for domain, expect := range map[string]string{
+		"a.foo.com.cn":      "foo.com.cn",
+		"a.b.c.ck":          "b.c.ck",
+		"a.www.ck":          "www.ck",
+		"x.y.xn--55qx5d.cn": "y.xn--55qx5d.cn",
+		"a.b.github.io":     "github.io",
+		"c.ck":              "",
+	} {
+		if got := registrableDomain(domain); got != expect {
+			t.Errorf("local list %s: expect %q, got %q", domain, expect, got)
+		}
+	}
+
+	parser, err := newRecordParser(benchInputFormat, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := parser.NewRecord()
+	expr, err := parseMatchExpr("registrable_domain in (=foo.com.cn)", nil, parser.logIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, expect := range map[string]bool{"a.b.foo.com.cn": true, "foo.com.cn": true, "bar.com.cn": false} {
+		if err := parser.Parse([]byte("r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|"+domain+"|1|0||1.1.1.1|3"), rec); err != nil {
+			t.Fatal(err)
+		}
+		rec.matched = matchedRule{}
+		if got := expr.eval(rec); got != expect || (got && rec.matchedName() != "foo.com.cn") {
+			t.Errorf("%s: expect %v, got %v (%q)", domain, expect, got, rec.matchedName())
+		}
+	}
+}
+
+// TestDomainNormalization 规则和查询的域名统一规范化大小写、末尾的点和 IDN，可选以 Unicode 形式输出
+func TestDomainNormalization(t *testing.T) {
+	tree := NewTrieNode()
+	tree.Insert("Example.COM.")
+	tree.Insert("=bücher.de")
+	tree.Insert("xn--fiqs8s.cn")
+	for domain, expect := range map[string]bool{
+		"WWW.example.com.":     true,
+		"xn--bcher-kva.de":     true,
+		"BÜCHER.de":            true,
+		"www.xn--bcher-kva.de": false,
+		"a.中国.cn":              true,
+		"a.XN--FIQS8S.CN.":     true,
+		"example.org":          false,
+	} {
+		if got := tree.Search(domain); got != expect {
+			t.Errorf("%s: expect %v, got %v", domain, expect, got)
+		}
+	}
+
+	task := &TaskInfo{Match: "domain in (=中国.cn, .AD1.Example.net)", OutputUnicode: true}
+	task.OutputFormat = transferFormat(benchInputFormat, "6,19,matched_name,registrable_domain")
+	tasks := newTestTasks(t, map[string]*TaskInfo{"unicode": task}, nil)
+	st := tasks.newFilterState("unicode")
+	defer st.release()
+	for _, domain := range []string{"XN--FIQS8S.cn.", "x.ad1.example.NET", "x.example.net"} {
+		tasks.filterLine([]byte("r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|"+domain+"|1|0|a.xn--fiqs8s.cn;b.com|1.1.1.1|3"), st)
+	}
+	expect := "中国.cn|a.中国.cn;b.com|中国.cn|中国.cn|\n" +
+		"x.ad1.example.NET|a.中国.cn;b.com|x.ad1.example.NET|example.net|\n"
+	if got := st.targets[0].buf.String(); got != expect {
+		t.Errorf("unexpected output:\n%s", got)
+	}
+}
+
+func TestRecordParser(t *testing.T) {
+	p, err := newRecordParser("r,12,3,4,1,2,5,6,7,14,19,15,13", "", "\\")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := p.NewRecord()
+
+	line := "r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|www.a.com|1|0||1.1.1.1;2.2.2.2|3"
+	if err := p.Parse([]byte(line), rec); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if rec.Domain() != "www.a.com" || rec.RequestIP() != "192.168.0.1" || rec.Result() != "1.1.1.1;2.2.2.2" {
+		t.Errorf("unexpected fields: %q", rec.Fields())
+	}
+
+	//行尾多一个分隔符
+	if err := p.Parse([]byte(line+"|"), rec); err != nil {
+		t.Errorf("trailing delimiter should be accepted: %v", err)
+	}
+
+	//字段不足时不能沿用上一行的字段
+	if err := p.Parse([]byte("r|2024-01-01 00:00:00|10.0.0.1"), rec); !errors.Is(err, errFieldCount) {
+		t.Errorf("expect errFieldCount, got %v", err)
+	}
+	if err := p.Parse([]byte(line+"|x|y"), rec); !errors.Is(err, errFieldCount) {
+		t.Errorf("expect errFieldCount, got %v", err)
+	}
+
+	//转义的分隔符
+	if err := p.Parse([]byte(strings.Replace(line, "www.a.com", "www\\|a.com", 1)), rec); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if rec.Domain() != "www|a.com" {
+		t.Errorf("unexpected domain %q", rec.Domain())
+	}
+
+	cases := map[string]string{
+		line: "",
+		strings.Replace(line, "192.168.0.1", "192.168.0", 1): rejectBadIP,
+		strings.Replace(line, "www.a.com", "", 1):            rejectEmptyQName,
+		strings.Replace(line, "|1|0|", "|XX|0|", 1):          rejectUnknownQType,
+	}
+	for l, reason := range cases {
+		if err := p.Parse([]byte(l), rec); err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		if got := p.Validate(rec); got != reason {
+			t.Errorf("%s: expect reject reason %q, got %q", l, reason, got)
+		}
+	}
+}
+
+// TestRecordRejects 同一文件多次分析时累加拒绝统计，超过 maxRejectFiles 个文件时淘汰最早的，原始日志写入 reject 文件
+func TestRecordRejects(t *testing.T) {
+	tasks := newTestTasks(t, map[string]*TaskInfo{"all": {Match: "domain in (a.com)"}}, nil)
+	tasks.RejectDir = t.TempDir()
+	tasks.RejectReasons = make(map[string]int)
+	tasks.RejectFileDetails = make(map[string]map[string]int)
+	valid := "r|2024-01-01 00:00:00|10.0.0.1|53|192.168.0.1|5353|1|www.a.com|1|0||1.1.1.1|3"
+	analyze := func(srcFileName string, lines ...string) {
+		st := tasks.newFilterState(srcFileName)
+		defer st.release()
+		for _, line := range lines {
+			tasks.filterLine([]byte(line), st)
+		}
+		tasks.recordRejects(srcFileName, st.rejects)
+	}
+
+	analyze("a.log", "broken line", valid, strings.Replace(valid, "192.168.0.1", "192.168.0", 1))
+	analyze("a.log", "broken line")
+	if details := tasks.RejectFileDetails["a.log"]; details[rejectFieldCount] != 2 || details[rejectBadIP] != 1 {
+		t.Errorf("reject counts should be merged, got %v", details)
+	}
+	data, err := os.ReadFile(path.Join(tasks.RejectDir, fmt.Sprintf("reject_%s.log", time.Now().Format("20060102"))))
+	if err != nil || strings.Count(string(data), "\n") != 3 || !strings.HasPrefix(string(data), rejectFieldCount+"|a.log|broken line\n") {
+		t.Errorf("unexpected reject file %q, %v", data, err)
+	}
+
+	for i := 0; i < maxRejectFiles; i++ {
+		tasks.recordRejects(fmt.Sprintf("%d.log", i), &rejectCounter{total: 1, reasons: map[string]int{rejectBadIP: 1}})
+	}
+	if _, ok := tasks.RejectFileDetails["a.log"]; ok || len(tasks.RejectFileDetails) != maxRejectFiles {
+		t.Errorf("oldest file should be evicted, %d files kept", len(tasks.RejectFileDetails))
+	}
+	if tasks.RejectedRecords != 3+maxRejectFiles || tasks.RejectReasons[rejectBadIP] != 1+maxRejectFiles {
+		t.Errorf("unexpected totals %d %v", tasks.RejectedRecords, tasks.RejectReasons)
+	}
+}
+
+// TestEventWindows 各分析线程共享 watermark，任一线程推进后关闭全部线程的窗口文件，空闲后关闭剩余窗口
+func TestEventWindows(t *testing.T) {
+	dir := t.TempDir()
+	task := &TaskInfo{Match: "domain in (a.com)", OutputDir: dir, OutputFileName: "out_time", EventTimeWindow: 5 * time.Minute, EventTimeLateness: time.Minute}
+	tasks := newTestTasks(t, map[string]*TaskInfo{"windowed": task}, nil)
+	task.eventWindows = newEventWindows(task.EventTimeWindow, task.EventTimeLateness, 0)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	write := func(taskId int, data map[time.Duration]string) {
+		target := &filterTarget{task: task, windowBufs: make(map[int64]*bytes.Buffer)}
+		for offset, s := range data {
+			eventTime := base.Add(offset)
+			target.windowBufs[eventWindowStart(eventTime, task.EventTimeWindow, time.Local)] = bytes.NewBufferString(s)
+			if eventTime.After(target.maxEventTime) {
+				target.maxEventTime = eventTime
+			}
+		}
+		tasks.writeEventWindows(target, taskId)
+	}
+	fileName := func(offset time.Duration, suffix string) string {
+		return path.Join(dir, "out_"+base.Add(offset).Format("20060102150405")+suffix)
+	}
+
+	//两个线程都写入 [00:00,00:05)，线程 1 推进 watermark 到 00:07 后两个文件都被关闭
+	write(0, map[time.Duration]string{time.Minute: "a"})
+	write(1, map[time.Duration]string{2 * time.Minute: "b"})
+	write(1, map[time.Duration]string{7 * time.Minute: "c"})
+	for _, name := range []string{fileName(0, "_0.gz"), fileName(0, "_1.gz"), fileName(5*time.Minute, "_1.gz.tmp")} {
+		if !fileExists(name) {
+			t.Errorf("missing %s", name)
+		}
+	}
+
+	//线程 0 此时仍在处理 00:03 的记录，按共享的 watermark 判为迟到
+	write(0, map[time.Duration]string{3 * time.Minute: "late"})
+	if data, _ := os.ReadFile(fileName(0, "_0_late.gz")); string(data) != "late" {
+		t.Errorf("record of closed window should be late, got %q", data)
+	}
+
+	//空闲后关闭剩余窗口，之后到达的同窗口记录按迟到处理
+	task.eventWindows.lock.Lock()
+	tasks.closeEventWindows(task, true)
+	task.eventWindows.lock.Unlock()
+	if !fileExists(fileName(5*time.Minute, "_1.gz")) {
+		t.Errorf("idle window should be closed")
+	}
+	write(0, map[time.Duration]string{6 * time.Minute: "d"})
+	if !fileExists(fileName(5*time.Minute, "_0_late.gz")) || len(task.eventWindows.open) != 0 {
+		t.Errorf("record of idle closed window should be late")
+	}
+
+	//1 天的窗口按配置的时区对齐到当地 0 点
+	cst := time.FixedZone("CST", 8*3600)
+	eventTime := time.Date(2024, 1, 2, 3, 0, 0, 0, cst)
+	if got := eventWindowStart(eventTime, 24*time.Hour, cst); got != time.Date(2024, 1, 2, 0, 0, 0, 0, cst).Unix() {
+		t.Errorf("unexpected window start %s", time.Unix(got, 0).In(cst))
+	}
+}
+
+// TestEventTimeTarget 响应时间无法解析的记录只在事件时间任务中跳过并计数，其他任务照常输出
+func TestEventTimeTarget(t *testing.T) {
+	tasks := newTestTasks(t, map[string]*TaskInfo{
+		"plain":    {Match: "domain in (a.com)", OutputFormatString: "full"},
+		"windowed": {Match: "domain in (a.com)", OutputFormatString: "full", EventTimeWindow: 5 * time.Minute},
+	}, nil)
+	var err error
+	if tasks.parser.eventTime, err = newEventTimeParser("", "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	st := tasks.newFilterState("event")
+	defer st.release()
+	for _, eventTime := range []string{"bad-time", "2024-01-01 00:01:00"} {
+		tasks.filterLine([]byte("r|"+eventTime+"|10.0.0.1|53|192.168.0.1|5353|1|www.a.com|1|0||1.1.1.1|3"), st)
+	}
+
+	if st.rejects.total != 0 {
+		t.Errorf("bad event time should not be rejected globally")
+	}
+	plain, windowed := st.targets[0], st.targets[1]
+	if plain.matched != 2 || strings.Count(plain.buf.String(), "\n") != 2 {
+		t.Errorf("plain task should output both records, got %d", plain.matched)
+	}
+	if windowed.matched != 1 || windowed.badEventTime != 1 || len(windowed.windowBufs) != 1 {
+		t.Errorf("unexpected windowed result: matched %d, bad event time %d", windowed.matched, windowed.badEventTime)
+	}
+}
+
+// TestFilterChunks 分块并行分析的结果顺序、统计与单个分块一致
+func TestFilterChunks(t *testing.T) {
+	dir := t.TempDir()
+	lines := benchLines()
+	var content bytes.Buffer
+	for i := 0; i < 20; i++ {
+		for _, line := range lines {
+			content.Write(line)
+			content.WriteByte('\n')
+		}
+		content.WriteString("broken line\n")
+	}
+	srcFile := dir + "/input.log"
+	if err := os.WriteFile(srcFile, content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(workers int, chunkSize int) *filterState {
+		task := &TaskInfo{OutputFormatString: "full", FilterTag: 01}
+		task.NewMatchRule(nil, []string{"domain.txt"})
+		task.taskMatchRule.load().domainTrie.Insert("*.example7.com")
+		tasks := newTestTasks(t, map[string]*TaskInfo{"full": task}, nil)
+		tasks.SplitWorkers, tasks.splitChunkSize = workers, chunkSize
+		st, err := tasks.filterChunks(srcFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	single := run(1, 1<<30)
+	parallel := run(4, 4096)
+	if single.nums != 20*(len(lines)+1) || single.rejects.total != 20 {
+		t.Fatalf("unexpected stats: nums %d, rejected %d", single.nums, single.rejects.total)
+	}
+	if parallel.nums != single.nums || parallel.rejects.total != single.rejects.total || parallel.targets[0].matched != single.targets[0].matched {
+		t.Errorf("stats mismatch: %d/%d/%d vs %d/%d/%d", parallel.nums, parallel.rejects.total, parallel.targets[0].matched,
+			single.nums, single.rejects.total, single.targets[0].matched)
+	}
+	if !bytes.Equal(parallel.targets[0].buf.Bytes(), single.targets[0].buf.Bytes()) {
+		t.Errorf("output order mismatch")
+	}
+}
+
+// TestRuleIndex 组合索引的匹配结果与逐个规则集查找一致，刷新清单后重建
+func TestRuleIndex(t *testing.T) {
+	dir := t.TempDir()
+	newTask := func(match string, domains, ips []string) *TaskInfo {
+		task := &TaskInfo{Match: match, FilterDomainRuler: domains, FilterIpRuler: ips}
+		task.FilterTag = task.getTaskType()
+		task.OutputFormat = transferFormat(benchInputFormat, "6,matched_name")
+		return task
+	}
+	force2 := writeRuleFile(t, dir, "force2.list", "*.example1.com", "=example2.com", "host7.example7.com")
+	force3 := writeRuleFile(t, dir, "force3.list", "*.example1.com", ".example3.com", "/^host1[0-9]\\./")
+	ipList := writeRuleFile(t, dir, "ip.list", "192.168.1.0/24", "10.1.1.1", "10.2.2.0-10.2.3.255", "2409:8720:0c01:2b::/120")
+
+	exclude := newTask("", force3, nil)
+	exclude.ExcludeIpRuler = writeRuleFile(t, dir, "exclude.list", "192.168.2.0/24")
+	tasks := newTestTasks(t, map[string]*TaskInfo{
+		"force2":  newTask("", force2, nil),
+		"force3":  newTask("domain in task or cname in task", force3, nil),
+		"client":  newTask("client in task", nil, ipList),
+		"answer":  newTask("answer in task and not domain in (=host3.example3.com)", force2, ipList),
+		"exclude": exclude,
+	}, nil)
+
+	// 同一批日志分别使用组合索引和逐个查找，各任务的输出必须一致
+	filter := func(indexed bool) []string {
+		st := tasks.newFilterState("index")
+		defer st.release()
+		if !indexed {
+			st.rec.index = nil
+		}
+		for _, line := range benchLines() {
+			tasks.filterLine(line, st)
+		}
+		var out []string
+		for _, target := range st.targets {
+			out = append(out, fmt.Sprintf("%s %d %d %s", target.name, target.matched, target.excluded, target.buf.String()))
+		}
+		return out
+	}
+	check := func() {
+		indexed, direct := filter(true), filter(false)
+		for i := range direct {
+			if indexed[i] != direct[i] {
+				t.Errorf("index mismatch:\n%.200s\n%.200s", indexed[i], direct[i])
+			}
+		}
+	}
+	check()
+
+	// 刷新任一任务的清单后重建索引
+	before := tasks.ruleIndex.Load()
+	writeRuleFile(t, dir, "force2.list", "=host8.example8.com")
+	tasks.TaskInfos["force2"].RefreshIPList()
+	if tasks.ruleIndex.Load() == before {
+		t.Fatalf("rule index should be rebuilt after refresh")
+	}
+	check()
+	if out := filter(true); !strings.HasPrefix(out[3], "force2 1 0 ") {
+		t.Errorf("unexpected result after refresh: %.100s", out[3])
+	}
+}
+
+// TestRuleRefreshRace 分析文件的同时反复刷新任务清单和命名规则集（配合 go test -race），
+// 每个文件只使用一份规则快照，命中数只能是刷新前或刷新后的结果
+func TestRuleRefreshRace(t *testing.T) {
+	dir := t.TempDir()
+	taskFile, setFile := dir+"/task.list", dir+"/set.list"
+	rulesA, rulesB := ".example7.com\n", ".example7.com\n.example8.com\n"
+	//先写临时文件再改名覆盖，避免读到写了一半的文件
+	writeRules := func(rules string) {
+		for _, file := range []string{taskFile, setFile} {
+			if err := os.WriteFile(file+".tmp", []byte(rules), 0644); err != nil {
+				t.Error(err)
+			}
+			if err := os.Rename(file+".tmp", file); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	writeRules(rulesA)
+
+	var content bytes.Buffer
+	for _, line := range benchLines() {
+		content.Write(line)
+		content.WriteByte('\n')
+	}
+	srcFile := dir + "/input.log"
+	if err := os.WriteFile(srcFile, content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := newMatchRule(nil, []string{setFile}, false)
+	shared.reload()
+	outputFormat := transferFormat(benchInputFormat, "6")
+	tasks := newTestTasks(t, map[string]*TaskInfo{
+		"task":   {FilterDomainRuler: []string{taskFile}, OutputFormat: outputFormat},
+		"shared": {Match: "domain in shared", OutputFormat: outputFormat},
+	}, map[string]*MatchRule{"shared": shared})
+	tasks.SplitWorkers, tasks.splitChunkSize = 4, 4096
+
+	done := make(chan struct{})
+	refreshed := make(chan int)
+	go func() {
+		i := 0
+		defer func() { refreshed <- i }()
+		for ; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				writeRules(rulesB)
+			} else {
+				writeRules(rulesA)
+			}
+			tasks.TaskInfos["task"].RefreshIPList()
+			tasks.refreshRuleSet(shared)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		st, err := tasks.filterChunks(srcFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, target := range st.targets {
+			if target.matched != 20 && target.matched != 40 {
+				t.Errorf("%s: %d matched, expected 20 or 40", target.name, target.matched)
+			}
+		}
+		st.release()
+	}
+	close(done)
+	if n := <-refreshed; n == 0 {
+		t.Errorf("rules were not refreshed during processing")
+	}
+}
+
+// TestRuleExpiry 到期和 expires / ttl 无效的条目加载时跳过，有条目到期时由定时器重新加载
+func TestRuleExpiry(t *testing.T) {
+	dir := t.TempDir()
+	soon := time.Now().Add(time.Second).Format(time.RFC3339)
+	task := &TaskInfo{
+		FilterDomainRuler: append(writeRuleFile(t, dir, "domain.list",
+			"old.com,expires=2020-01-01", "soon.com,category=c2,expires="+soon, "keep.com", "ttl.com,ttl=1h", "bad.com,expires=tomorrow"),
+			writeRuleFile(t, dir, "hosts.txt", "0.0.0.0 h1.com h2.com,expires=2020-01-01", "0.0.0.0 h3.com,ttl=1h")...),
+		FilterIpRuler: writeRuleFile(t, dir, "ip.list", "10.0.0.0/8,expires=2020-01-01 08:00:00", "192.168.0.1,ttl=30d", "10.9.9.9,ttl=soon"),
+	}
+	domainFile := task.FilterDomainRuler[0]
+	tasks := newTestTasks(t, map[string]*TaskInfo{"ioc": task}, nil)
+
+	check := func(expect map[string]bool) {
+		t.Helper()
+		snap := task.taskMatchRule.load()
+		for value, want := range expect {
+			got := snap.domainMatch(value)
+			if _, err := netip.ParseAddr(value); err == nil {
+				got = snap.ipMatch(value)
+			}
+			if got != want {
+				t.Errorf("%s: got %v, want %v", value, got, want)
+			}
+		}
+	}
+	check(map[string]bool{"old.com": false, "soon.com": true, "keep.com": true, "ttl.com": true, "bad.com": false,
+		"h1.com": false, "h3.com": true, "10.1.1.1": false, "10.9.9.9": false, "192.168.0.1": true})
+	stats := task.taskMatchRule.GetDomainFileStats()
+	if len(stats) != 2 || stats[0].Accepted != 3 || stats[0].Expired != 1 || stats[0].Skipped != 1 ||
+		stats[1].Format != ruleFormatHosts || stats[1].Accepted != 1 || stats[1].Expired != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	entries, err := scanRuleExpiry(domainFile, false)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("unexpected entries %+v, %v", entries, err)
+	}
+
+	// soon.com 到期后由定时器重新加载，不依赖新的输入文件
+	for deadline := time.Now().Add(5 * time.Second); task.taskMatchRule.load().domainMatch("soon.com"); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expired rule was not reloaded")
+		}
+	}
+	check(map[string]bool{"keep.com": true, "ttl.com": true})
+
+	// ttl 从修改时间起算，修改时间提前 2 小时后 ttl.com 也到期
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(domainFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	task.RefreshIPList()
+	check(map[string]bool{"soon.com": false, "keep.com": true, "ttl.com": false, "192.168.0.1": true})
+	//h3.com 的 ttl 从 hosts 文件的修改时间起算，早于 192.168.0.1 的 30 天
+	if next := task.taskMatchRule.load().nextExpiry; !next.After(time.Now().Add(59*time.Minute)) || next.After(time.Now().Add(time.Hour)) {
+		t.Errorf("unexpected next expiry %v", next)
+	}
+
+	//规则源缓存和数据库同步的清单每次同步都会改写，带 ttl 的条目不加载
+	managed := writeRuleFile(t, dir, "managed.list", "m1.com,ttl=1h", "m2.com,expires=2099-01-01")[0]
+	markManagedRuleFile(managed)
+	if _, stats := domainRuleFilesToTree([]string{managed}, false); stats[0].Accepted != 1 || stats[0].Skipped != 1 {
+		t.Errorf("ttl in managed rule file should be skipped: %+v", stats[0])
+	}
+	tasks.expiryLock.Lock()
+	defer tasks.expiryLock.Unlock()
+	if tasks.expiryTimer == nil {
+		t.Errorf("expiry timer should be scheduled for h3.com")
+	}
+}
+
+// TestRuleSource 规则源使用条件请求获取并写入缓存，超出大小或获取失败时保留上次的内容
+func TestRuleSource(t *testing.T) {
+	body, etag, fail := "0.0.0.0 a.com\n", `"v1"`, false
+	requests, conditional := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	task := &TaskInfo{FilterDomainRuler: []string{"hosts:" + srv.URL + "/feeds/hosts.txt"}}
+	tasks := &Tasks{
+		TaskInfos:               map[string]*TaskInfo{"feed": task},
+		RuleSourceCacheDir:      dir,
+		RuleSourceMaxSizeString: "1k",
+	}
+	tasks.initRuleSources()
+	src := tasks.ruleSources[srv.URL+"/feeds/hosts.txt"]
+	if task.FilterDomainRuler[0] != "hosts:"+src.cacheFile || !strings.HasSuffix(src.cacheFile, "-hosts.txt") {
+		t.Fatalf("unexpected cache file %s", task.FilterDomainRuler[0])
+	}
+	task.NewMatchRule(nil, task.FilterDomainRuler)
+	if !task.taskMatchRule.load().domainMatch("a.com") {
+		t.Errorf("rules should be loaded from cache")
+	}
+
+	fetch := func() (bool, error) {
+		return src.fetch(tasks.ruleSourceClient, tasks.ruleSourceMaxSize)
+	}
+	if updated, err := fetch(); updated || err != nil || conditional != 1 {
+		t.Errorf("unchanged source should not update: %v %v %d", updated, err, conditional)
+	}
+	body, etag = "0.0.0.0 b.com\n", `"v2"`
+	if updated, err := fetch(); !updated || err != nil {
+		t.Errorf("changed source should update: %v %v", updated, err)
+	}
+
+	// 超出大小限制和获取失败时缓存不变
+	lastSuccess := src.getStatus().LastSuccess
+	body, etag = strings.Repeat("0.0.0.0 c.com\n", 100), `"v3"`
+	if _, err := fetch(); err == nil {
+		t.Errorf("oversized source should be rejected")
+	}
+	fail = true
+	if _, err := fetch(); err == nil {
+		t.Errorf("failed fetch should return error")
+	}
+	if content, _ := os.ReadFile(src.cacheFile); string(content) != "0.0.0.0 b.com\n" {
+		t.Errorf("cache should keep last good content: %q", content)
+	}
+	if status := src.getStatus(); status.LastError == "" || !status.LastSuccess.Equal(lastSuccess) {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// 重启后使用保存的 ETag 发送条件请求
+	if restarted := newRuleSource(src.url, dir); restarted.status.ETag != `"v2"` {
+		t.Errorf("etag should be restored, got %q", restarted.status.ETag)
+	}
+	if requests != 5 {
+		t.Errorf("unexpected request count %d", requests)
+	}
+}
+
+// TestSQLSources 多个数据库规则源合并去重后写入清单，其余列写为元数据，查询失败时保留当前清单
+func TestSQLSources(t *testing.T) {
+	dir := t.TempDir()
+	dsn := dir + "/rules.db"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"create table ioc (domain text, category text, expires text)",
+		"insert into ioc values ('a.com', 'c2', '2099-01-01'), ('b.com', null, null)",
+		"create table feed (name text, note text)",
+		"insert into feed values ('a.com', 'dup'), ('c.com', 'x,y')",
+		"create table nets (cidr text, id integer)",
+		"insert into nets values ('10.0.0.0/8', 7)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	task := &TaskInfo{
+		SQLSources: []*SQLSourceInfo{
+			{Driver: "sqlite3", DSN: dsn, Query: "select domain, category, expires from ioc"},
+			{Driver: "sqlite", DSN: dsn, Query: "SELECT name, note AS category FROM feed"},
+			{Driver: "sqlite", DSN: dsn, Query: "select cidr, id from nets", Type: "ip"},
+		},
+		SQLDomainList: dir + "/domain.list",
+		SQLIPList:     dir + "/ip.list",
+	}
+	if err := task.initSQLSources("ioc"); err != nil {
+		t.Fatal(err)
+	}
+	if len(task.FilterDomainRuler) != 1 || len(task.FilterIpRuler) != 1 {
+		t.Fatalf("unexpected rulers %v %v", task.FilterDomainRuler, task.FilterIpRuler)
+	}
+
+	expect := map[string]string{
+		dir + "/domain.list": "a.com,category=c2,expires=2099-01-01\nb.com\nc.com,category=x y\n",
+		dir + "/ip.list":     "10.0.0.0/8,id=7\n",
+	}
+	for file, want := range expect {
+		if content, _ := os.ReadFile(file); string(content) != want {
+			t.Errorf("%s: got %q, want %q", file, content, want)
+		}
+	}
+
+	task.NewMatchRule(task.FilterIpRuler, task.FilterDomainRuler)
+	snap := task.taskMatchRule.load()
+	if !snap.domainMatch("www.c.com") || !snap.ipMatch("10.1.2.3") {
+		t.Errorf("rules from sql sources should be loaded")
+	}
+
+	// 启动时数据库不可用也创建空清单
+	offline := &TaskInfo{
+		SQLSources:    []*SQLSourceInfo{{Driver: "sqlite", DSN: dir + "/missing/rules.db", Query: "select domain from ioc"}},
+		SQLDomainList: dir + "/offline.list",
+	}
+	if err := offline.initSQLSources("offline"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(dir + "/offline.list"); err != nil || len(content) != 0 {
+		t.Errorf("empty list should be created: %q %v", content, err)
+	}
+
+	// 查询失败或结果大量减少时不更新清单
+	keep := func(reason string) {
+		t.Helper()
+		if task.syncSQLSources() {
+			t.Errorf("%s: list should not be replaced", reason)
+		}
+		if content, _ := os.ReadFile(dir + "/domain.list"); string(content) != expect[dir+"/domain.list"] {
+			t.Errorf("%s: list should be kept, got %q", reason, content)
+		}
+	}
+	task.SQLSources = task.SQLSources[:2]
+	task.SQLSources[1].Query = "select name from missing"
+	keep("query error")
+	task.SQLSources[1].Query = "select name from feed where 1 = 0"
+	task.SQLSources[0].Query = "select domain from ioc where domain = 'b.com'"
+	keep("shrink")
+
+	task.sqlMaxShrink = 100
+	if !task.syncSQLSources() {
+		t.Errorf("list should be replaced when shrink check is disabled")
+	}
+	if content, _ := os.ReadFile(dir + "/domain.list"); string(content) != "b.com\n" {
+		t.Errorf("unexpected list %q", content)
+	}
+	//结果为空时只有开启 sql_allow_empty 才替换
+	task.SQLSources[0].Query = "select domain from ioc where 1 = 0"
+	expect[dir+"/domain.list"] = "b.com\n"
+	keep("empty result")
+	task.SQLAllowEmpty = true
+	if !task.syncSQLSources() {
+		t.Errorf("empty result should be written with sql_allow_empty")
+	}
+
+	//sql_max_shrink 配置为 0 时不允许减少，未配置时使用默认值
+	for _, c := range []struct {
+		config *int
+		expect int
+	}{{nil, defaultSQLMaxShrink}, {new(int), 0}} {
+		shrink := &TaskInfo{SQLSources: task.SQLSources, SQLDomainList: dir + "/shrink.list", SQLMaxShrink: c.config}
+		if err := shrink.initSQLSources("shrink"); err != nil || shrink.sqlMaxShrink != c.expect {
+			t.Errorf("unexpected sql_max_shrink %d, %v", shrink.sqlMaxShrink, err)
+		}
+	}
+	if tmp, _ := filepath.Glob(dir + "/*.tmp"); len(tmp) != 0 {
+		t.Errorf("temp files left: %v", tmp)
+	}
+}
+
+const benchInputFormat = "r,12,3,4,1,2,5,6,7,14,19,15,13"
+
+// writeRuleFile 在 dir 下写入规则文件，每个参数一行，返回可直接用于规则清单配置的路径
+func writeRuleFile(t testing.TB, dir string, name string, lines ...string) []string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return []string{file}
+}
+
+// newTestTasks 按 benchInputFormat 创建解析器，加载并编译各任务的规则后建立组合索引，
+// 与 readConf 的初始化顺序一致。已调用过 NewMatchRule 的任务不再重新加载
+func newTestTasks(t testing.TB, infos map[string]*TaskInfo, ruleSets map[string]*MatchRule) *Tasks {
+	t.Helper()
+	parser, err := newRecordParser(benchInputFormat, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := &Tasks{TaskInfos: infos, ruleSets: ruleSets, parser: parser}
+	for name, task := range infos {
+		if task.FilterTag == 0 {
+			task.FilterTag = task.getTaskType()
+		}
+		if task.taskMatchRule == nil {
+			task.NewMatchRule(task.FilterIpRuler, task.FilterDomainRuler)
+		}
+		if err := task.compileMatch(ruleSets, parser.logIndex); err != nil {
+			t.Fatalf("task %s: %v", name, err)
+		}
+	}
+	tasks.initRuleIndex()
+	return tasks
+}
+
+// benchLines 生成用于基准测试的日志，部分记录能命中规则
+func benchLines() [][]byte {
+	var lines [][]byte
+	for i := 0; i < 1000; i++ {
+		domain := fmt.Sprintf("host%d.example%d.com", i, i%50)
+		answer := fmt.Sprintf("10.%d.%d.1;10.%d.%d.2", i%5, i%250, i%5, i%250)
+		if i%3 == 0 {
+			answer = fmt.Sprintf("2409:8720:0c01:2b::%x", i)
+		}
+		lines = append(lines, []byte(fmt.Sprintf("r|2024-01-01 00:00:%02d|10.0.0.1|53|192.168.%d.%d|5353|%d|%s|1|0||%s|3",
+			i%60, i%4, i%250, i, domain, answer)))
+	}
+	return lines
+}
+
+// benchmarkFilterLine 测试单个任务的逐行解析、匹配和输出，报告 lines/s 和 allocs/op
+func benchmarkFilterLine(b *testing.B, task *TaskInfo) {
+	dir := b.TempDir()
+	if task.FilterDomainRuler != nil {
+		task.FilterDomainRuler = writeRuleFile(b, dir, "domain.list", "*.example1.com", "host7.example7.com")
+	}
+	if task.FilterIpRuler != nil {
+		task.FilterIpRuler = writeRuleFile(b, dir, "ip.list", "192.168.1.0/24", "10.1.1.1", "10.2.2.0/24", "2409:8720:0c01:2b::9")
+	}
+	task.OutputFormat = transferFormat(benchInputFormat, "6,1,12,17,18")
+	tasks := newTestTasks(b, map[string]*TaskInfo{"bench": task}, nil)
+	st := tasks.newFilterState("bench")
+	lines := benchLines()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tasks.filterLine(lines[i%len(lines)], st)
+		if buf := st.targets[0].buf; buf.Len() > 1<<20 {
+			buf.Reset()
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+}
+
+func BenchmarkFilterDomain(b *testing.B) {
+	benchmarkFilterLine(b, &TaskInfo{FilterDomainRuler: []string{}, OutputFormatString: "6,1,12,17,18"})
+}
+
+func BenchmarkFilterRequestIP(b *testing.B) {
+	benchmarkFilterLine(b, &TaskInfo{FilterIpRuler: []string{}, OutputFormatString: "6,1,12,17,18"})
+}
+
+func BenchmarkFilterResolveIP(b *testing.B) {
+	benchmarkFilterLine(b, &TaskInfo{FilterIpRuler: []string{}, IsMatchResolveIP: true, OutputFormatString: "6,1,12,17,18"})
+}
+
+func BenchmarkFilterDomainAndIP(b *testing.B) {
+	benchmarkFilterLine(b, &TaskInfo{FilterDomainRuler: []string{}, FilterIpRuler: []string{}, OutputFormatString: "6,1,12,17,18"})
+}
+
+func BenchmarkFilterDomainJituan(b *testing.B) {
+	benchmarkFilterLine(b, &TaskInfo{FilterDomainRuler: []string{}, OutputFormatString: "jituan"})
+}
+
+func BenchmarkFilterDomainFull(b *testing.B) {
+	benchmarkFilterLine(b, &TaskInfo{FilterDomainRuler: []string{}, OutputFormatString: "full"})
+}
+
 func main_test() {
 	tree := NewTrieNode()
 
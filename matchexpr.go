@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 任务自身的 filter_domain_ruler / filter_ip_ruler 在表达式中的规则集名
+const taskRuleSetName = "task"
+
+// matchExpr 编译后的匹配表达式，每条记录求值一次
+type matchExpr interface {
+	eval(rec *Record) bool
+}
+
+type andExpr struct{ left, right matchExpr }
+
+func (e *andExpr) eval(rec *Record) bool { return e.left.eval(rec) && e.right.eval(rec) }
+
+type orExpr struct{ left, right matchExpr }
+
+func (e *orExpr) eval(rec *Record) bool { return e.left.eval(rec) || e.right.eval(rec) }
+
+type notExpr struct{ expr matchExpr }
+
+func (e *notExpr) eval(rec *Record) bool { return !e.expr.eval(rec) }
+
+// 表达式中可引用的记录字段
+const (
+	matchFieldDomain = "domain" // 请求域名
+	matchFieldCNAME  = "cname"  // cname 链中的任一域名
+	matchFieldClient = "client" // 请求 IP
+	matchFieldAnswer = "answer" // 响应中的任一地址
+	matchFieldQType  = "qtype"  // 请求类型
+	matchFieldRCode  = "rcode"  // 响应编码
+	matchFieldServer = "server" // DNS服务IP
+
+	matchFieldRegistrable = "registrable_domain" // 请求域名的可注册域名（eTLD+1）
+)
+
+// 任务的 filter_dns_server_ruler 在表达式中的规则集名
+const dnsServerRuleSetName = "task_dns_server"
+
+// setExpr 字段是否命中规则集
+type setExpr struct {
+	field string
+	index int // 组合索引中的字段
+	set   *MatchRule
+}
+
+func (e *setExpr) eval(rec *Record) bool {
+	// 组合索引中未命中时直接返回；命中时使用查找索引时记录的命中项，不再逐项查找规则集。
+	// 记录的快照为索引构建时的快照，输出元数据时与索引的结果一致
+	if bit := e.set.indexBit; bit >= 0 && rec.index != nil {
+		if !rec.indexedBits(e.index).has(bit) {
+			return false
+		}
+		if rec.matched.set != nil {
+			return true
+		}
+		value, _ := rec.indexedMatch(e.index, bit)
+		isIP := e.field == matchFieldClient || e.field == matchFieldServer || e.field == matchFieldAnswer
+		return rec.setMatched(rec.index.sets[bit], value, isIP)
+	}
+
+	snap := e.set.load()
+	switch e.field {
+	case matchFieldDomain:
+		return snap.domainMatch(rec.Domain()) && rec.setMatched(snap, rec.Domain(), false)
+	case matchFieldRegistrable:
+		name := registrableDomain(rec.Domain())
+		return name != "" && snap.domainMatch(name) && rec.setMatched(snap, name, false)
+	case matchFieldCNAME:
+		for name, rest := cutAnswer(rec.CNAME()); name != "" || rest != ""; name, rest = cutAnswer(rest) {
+			if name != "" && snap.domainMatch(name) {
+				return rec.setMatched(snap, name, false)
+			}
+		}
+		return false
+	case matchFieldClient:
+		return snap.requestIPMatch(rec.RequestIP()) && rec.setMatched(snap, rec.RequestIP(), true)
+	case matchFieldServer:
+		return snap.requestIPMatch(rec.DNSServer()) && rec.setMatched(snap, rec.DNSServer(), true)
+	case matchFieldAnswer:
+		for ip, rest := cutAnswer(rec.Result()); ip != "" || rest != ""; ip, rest = cutAnswer(rest) {
+			if snap.ipMatch(ip) {
+				return rec.setMatched(snap, ip, true)
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// codeExpr 数字类字段是否在取值列表中
+type codeExpr struct {
+	field string
+	codes map[int]struct{}
+}
+
+func (e *codeExpr) eval(rec *Record) bool {
+	var code int
+	var ok bool
+	switch e.field {
+	case matchFieldQType:
+		code, ok = parseQType(rec.QType())
+	case matchFieldRCode:
+		code, ok = parseRCode(rec.RCode())
+	}
+	if !ok {
+		return false
+	}
+	_, ok = e.codes[code]
+	return ok
+}
+
+// domain_match_scope 的取值：域名规则匹配请求域名、cname 链或两者
+const (
+	domainScopeQName = "qname"
+	domainScopeCNAME = "cname"
+	domainScopeBoth  = "both"
+)
+
+// legacyMatch 将 filter_domain_ruler / filter_ip_ruler / is_match_resolve_ip 组合（FilterTag）转换为表达式，
+// scope 决定域名规则匹配请求域名还是 cname 链
+func legacyMatch(tag int, scope string) string {
+	domain := "domain in task"
+	switch scope {
+	case domainScopeCNAME:
+		domain = "cname in task"
+	case domainScopeBoth:
+		domain = "(domain in task or cname in task)"
+	}
+
+	switch tag {
+	case 01:
+		return domain
+	case 10:
+		return "client in task"
+	case 20:
+		return "answer in task"
+	case 11:
+		return domain + " and client in task"
+	case 21:
+		return domain + " and answer in task"
+	}
+	return ""
+}
+
+// compileMatch 编译任务的 match 表达式，未配置时由旧的过滤配置生成，
+// filter_qtype / filter_rcode / filter_dns_server_ruler 以 and 追加在表达式之后。
+// 表达式为空时任务不匹配任何记录，与旧版本行为一致
+func (t *TaskInfo) compileMatch(ruleSets map[string]*MatchRule, idx logIndex) error {
+	switch t.DomainMatchScope {
+	case "", domainScopeQName, domainScopeCNAME, domainScopeBoth:
+	default:
+		return fmt.Errorf("invalid domain_match_scope %q, expected qname, cname or both", t.DomainMatchScope)
+	}
+
+	var conditions []string
+	if source := t.Match; source != "" {
+		conditions = append(conditions, source)
+	} else if source = legacyMatch(t.FilterTag, t.DomainMatchScope); source != "" {
+		conditions = append(conditions, source)
+	}
+	if len(t.FilterQType) > 0 {
+		conditions = append(conditions, fmt.Sprintf("qtype in (%s)", strings.Join(t.FilterQType, ", ")))
+	}
+	if len(t.FilterRCode) > 0 {
+		conditions = append(conditions, fmt.Sprintf("rcode in (%s)", strings.Join(t.FilterRCode, ", ")))
+	}
+	if t.dnsServerRule != nil {
+		conditions = append(conditions, "server in "+dnsServerRuleSetName)
+	}
+
+	t.matchExpr = nil
+	t.matchSource = ""
+	switch len(conditions) {
+	case 0:
+		return nil
+	case 1:
+		t.matchSource = conditions[0]
+	default:
+		t.matchSource = "(" + strings.Join(conditions, ") and (") + ")"
+	}
+
+	sets := map[string]*MatchRule{taskRuleSetName: t.taskMatchRule}
+	if t.dnsServerRule != nil {
+		sets[dnsServerRuleSetName] = t.dnsServerRule
+	}
+	for name, set := range ruleSets {
+		if name == taskRuleSetName || name == dnsServerRuleSetName {
+			return fmt.Errorf("rule set name %q is reserved", name)
+		}
+		sets[name] = set
+	}
+
+	expr, err := parseMatchExpr(t.matchSource, sets, idx)
+	if err != nil {
+		return err
+	}
+	t.matchExpr = expr
+	return nil
+}
+
+// matchToken 表达式的词法单元
+type matchToken struct {
+	text string
+	pos  int
+}
+
+// tokenizeMatch 按空白、括号和逗号切分表达式
+func tokenizeMatch(src string) []matchToken {
+	var tokens []matchToken
+	for i := 0; i < len(src); {
+		switch c := src[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, matchToken{text: src[i : i+1], pos: i})
+			i++
+		default:
+			start := i
+			for i < len(src) && !strings.ContainsRune(" \t\n\r(),", rune(src[i])) {
+				i++
+			}
+			tokens = append(tokens, matchToken{text: src[start:i], pos: start})
+		}
+	}
+	return tokens
+}
+
+// matchParser 递归下降解析：
+//
+//	expr   = term { "or" term }
+//	term   = factor { "and" factor }
+//	factor = "not" factor | "(" expr ")" | field [ "not" ] "in" ( 规则集名 | "(" 值 { "," 值 } ")" )
+type matchParser struct {
+	src    string
+	tokens []matchToken
+	pos    int
+	sets   map[string]*MatchRule
+	idx    logIndex
+}
+
+// parseMatchExpr 解析并编译表达式，规则集名在 sets 中查找
+func parseMatchExpr(src string, sets map[string]*MatchRule, idx logIndex) (matchExpr, error) {
+	p := &matchParser{src: src, tokens: tokenizeMatch(src), sets: sets, idx: idx}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+func (p *matchParser) errorf(format string, args ...any) error {
+	pos := len(p.src)
+	if p.pos < len(p.tokens) {
+		pos = p.tokens[p.pos].pos
+	}
+	return fmt.Errorf("match %q at %d: %s", p.src, pos, fmt.Sprintf(format, args...))
+}
+
+// peek 当前词法单元，关键字不区分大小写
+func (p *matchParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *matchParser) accept(keyword string) bool {
+	if strings.EqualFold(p.peek(), keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *matchParser) expect(keyword string) error {
+	if !p.accept(keyword) {
+		if p.peek() == "" {
+			return p.errorf("expected %q, got end of expression", keyword)
+		}
+		return p.errorf("expected %q, got %q", keyword, p.peek())
+	}
+	return nil
+}
+
+func (p *matchParser) parseOr() (matchExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *matchParser) parseAnd() (matchExpr, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *matchParser) parseFactor() (matchExpr, error) {
+	if p.accept("not") {
+		expr, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr}, nil
+	}
+	if p.accept("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	}
+	return p.parseCondition()
+}
+
+// parseCondition 解析 field [not] in ...
+func (p *matchParser) parseCondition() (matchExpr, error) {
+	field := strings.ToLower(p.peek())
+	if field == "" {
+		return nil, p.errorf("expected field, got end of expression")
+	}
+	if err := p.checkField(field); err != nil {
+		return nil, err
+	}
+	p.pos++
+
+	negate := p.accept("not")
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+
+	var expr matchExpr
+	var err error
+	if p.accept("(") {
+		expr, err = p.parseValues(field)
+	} else {
+		expr, err = p.parseSetName(field)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if negate {
+		return &notExpr{expr}, nil
+	}
+	return expr, nil
+}
+
+// checkField 字段是否支持，且在 input_format 中存在
+func (p *matchParser) checkField(field string) error {
+	var index int
+	switch field {
+	case matchFieldDomain, matchFieldRegistrable:
+		index = p.idx.DomainIndex
+	case matchFieldCNAME:
+		index = p.idx.CNAMEIndex
+	case matchFieldClient:
+		index = p.idx.RequestIPIndex
+	case matchFieldAnswer:
+		index = p.idx.ResultIndex
+	case matchFieldQType:
+		index = p.idx.RequestTypeIndex
+	case matchFieldRCode:
+		index = p.idx.RCodeIndex
+	case matchFieldServer:
+		index = p.idx.DNSServerIndex
+	default:
+		return p.errorf("unknown field %q", field)
+	}
+	if index < 0 {
+		return p.errorf("field %q is not in input_format", field)
+	}
+	return nil
+}
+
+func (p *matchParser) parseSetName(field string) (matchExpr, error) {
+	name := p.peek()
+	if field == matchFieldQType || field == matchFieldRCode {
+		return nil, p.errorf("%s only supports a value list, e.g. qtype in (A, AAAA)", field)
+	}
+	set, ok := p.sets[name]
+	if !ok {
+		return nil, p.errorf("unknown rule set %q", name)
+	}
+	p.pos++
+	return &setExpr{field: field, index: indexField(field), set: set}, nil
+}
+
+// parseValues 解析括号内的取值列表，域名和 IP 构建为匿名规则集
+func (p *matchParser) parseValues(field string) (matchExpr, error) {
+	var values []string
+	for {
+		value := p.peek()
+		if value == "" || value == "(" || value == ")" || value == "," {
+			return nil, p.errorf("expected value, got %q", value)
+		}
+		values = append(values, value)
+		p.pos++
+		if p.accept(")") {
+			break
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+
+	if field == matchFieldQType || field == matchFieldRCode {
+		parse := parseQType
+		if field == matchFieldRCode {
+			parse = parseRCode
+		}
+		codes := make(map[int]struct{}, len(values))
+		for _, value := range values {
+			code, ok := parse(value)
+			if !ok {
+				return nil, p.errorf("unknown %s %q", field, value)
+			}
+			codes[code] = struct{}{}
+		}
+		return &codeExpr{field: field, codes: codes}, nil
+	}
+
+	set := newMatchRule(nil, nil, false)
+	snap := set.load()
+	for _, value := range values {
+		var err error
+		switch {
+		case field == matchFieldDomain || field == matchFieldCNAME || field == matchFieldRegistrable:
+			snap.domainTrie.Insert(value)
+		case strings.Contains(value, ":"):
+			err = snap.v6Trie.InsertRule(value)
+			snap.ipFilterMode |= ipModeV6
+		default:
+			err = snap.v4Ranges.InsertRule(value)
+			snap.ipFilterMode |= ipModeV4
+		}
+		if err != nil {
+			return nil, p.errorf("invalid value %q: %v", value, err)
+		}
+	}
+	snap.v4Ranges.Compact()
+	return &setExpr{field: field, index: indexField(field), set: set}, nil
+}
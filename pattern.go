@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// domainPattern 规则文件中的正则或通配符规则
+type domainPattern struct {
+	expr   string // 转换后的正则
+	source string // 文件:行号，用于报错
+	meta   *ruleMeta
+}
+
+// patternMatcher 将一个任务的全部正则/通配符规则合并为一个正则，每个域名只匹配一次
+type patternMatcher struct {
+	re    *regexp.Regexp
+	count int
+
+	// 合并后的正则无法编译（如超出长度限制）时逐个匹配
+	res []*regexp.Regexp
+
+	// 带元数据的规则单独保留，仅在输出元数据时逐个匹配
+	metaRes   []*regexp.Regexp
+	metaMetas []*ruleMeta
+}
+
+// parseDomainPattern 判断规则是否为正则或通配符，返回对应的正则表达式：
+//
+//	re:<regex> 或 /<regex>/，以及以 ^ 开头或以 $ 结尾的行视为正则，按子串查找
+//	包含 * ? [ 的行（开头的 *. 除外）视为通配符，整体匹配：* 匹配任意字符，? 匹配单个字符，[...] 为字符集，
+//	字符集后的 + 表示重复一次或多次，如 ad[0-9]+.*.example.net
+//
+// 查找的域名已规范化为小写、不带末尾的点，通配符按同样方式处理，正则原样保留
+func parseDomainPattern(rule string) (string, bool) {
+	switch {
+	case strings.HasPrefix(rule, "re:"):
+		return rule[3:], true
+	case len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+		return rule[1 : len(rule)-1], true
+	case strings.HasPrefix(rule, "^") || strings.HasSuffix(rule, "$"):
+		return rule, true
+	}
+
+	if strings.ContainsAny(strings.TrimPrefix(rule, "*."), "*?[") {
+		return globToRegexp(strings.ToLower(strings.TrimSuffix(rule, "."))), true
+	}
+	return "", false
+}
+
+// globToRegexp 将通配符转换为整体匹配的正则
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	afterClass := false
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*':
+			expr.WriteString(".*")
+		case c == '?':
+			expr.WriteString(".")
+		case c == '+' && afterClass:
+			expr.WriteString("+")
+		case c == '[':
+			// 字符集原样保留，未闭合时按字面量处理
+			if end := strings.IndexByte(glob[i:], ']'); end > 0 {
+				expr.WriteString(glob[i : i+end+1])
+				i += end
+				afterClass = true
+				continue
+			}
+			expr.WriteString(`\[`)
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+		afterClass = false
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
+
+// compilePatterns 逐个校验规则并合并，无法编译的规则按文件和行号报错后跳过
+func compilePatterns(patterns []domainPattern) *patternMatcher {
+	var exprs []string
+	var res []*regexp.Regexp
+	m := &patternMatcher{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p.expr)
+		if err != nil {
+			fmt.Printf("Error compiling domain pattern at %s: %v\n", p.source, err)
+			continue
+		}
+		exprs = append(exprs, "(?:"+p.expr+")")
+		res = append(res, re)
+		if p.meta != nil {
+			m.metaRes = append(m.metaRes, re)
+			m.metaMetas = append(m.metaMetas, p.meta)
+		}
+	}
+	if len(exprs) == 0 {
+		return nil
+	}
+
+	re, err := regexp.Compile(strings.Join(exprs, "|"))
+	if err != nil {
+		fmt.Printf("Error merging %d domain patterns, matching them one by one: %v\n", len(exprs), err)
+		m.res = res
+	}
+	m.re = re
+	m.count = len(exprs)
+	return m
+}
+
+// Match 域名是否命中任意一条规则
+func (m *patternMatcher) Match(domain string) bool {
+	if m.re != nil {
+		return m.re.MatchString(domain)
+	}
+	for _, re := range m.res {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupMeta 第一条命中的带元数据规则的元数据
+func (m *patternMatcher) lookupMeta(domain string) *ruleMeta {
+	for i, re := range m.metaRes {
+		if re.MatchString(domain) {
+			return m.metaMetas[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// defaultPublicSuffixFile 本地公共后缀列表的默认位置，存在时代替程序内置的列表
+const defaultPublicSuffixFile = "public_suffix_list.dat"
+
+// 公共后缀规则的类型，同一后缀可以同时有多种
+const (
+	pslNormal    byte = 1 // com.cn
+	pslWildcard  byte = 2 // *.ck，记录在 ck 上
+	pslException byte = 4 // !www.ck
+)
+
+// suffixList 从 public_suffix_list.dat 加载的公共后缀列表
+type suffixList struct {
+	rules map[string]byte
+}
+
+// publicSuffixes 本地公共后缀列表，为 nil 时使用 golang.org/x/net/publicsuffix 内置的列表
+var publicSuffixes *suffixList
+
+// parseSuffixList 解析 publicsuffix.org 格式的列表：每行第一个空白前的内容为规则，// 开头为注释，
+// 规则中的 Unicode 域名转换为 punycode
+func parseSuffixList(r io.Reader) (*suffixList, error) {
+	list := &suffixList{rules: make(map[string]byte)}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+
+		kind := pslNormal
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			rule, kind = rule[1:], pslException
+		case rule == "*":
+			continue // 默认规则，无需记录
+		case strings.HasPrefix(rule, "*."):
+			rule, kind = rule[2:], pslWildcard
+		}
+
+		ascii, err := idna.ToASCII(rule)
+		if err != nil || ascii == "" {
+			return nil, fmt.Errorf("line %d: invalid rule %q", lineNum, fields[0])
+		}
+		list.rules[ascii] |= kind
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(list.rules) == 0 {
+		return nil, fmt.Errorf("no rules found")
+	}
+	return list, nil
+}
+
+// loadSuffixListFile 读取并解析本地公共后缀列表
+func loadSuffixListFile(file string) (*suffixList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseSuffixList(f)
+}
+
+// publicSuffix 按 publicsuffix.org 的算法取公共后缀：从最长的后缀开始查找，
+// 例外规则去掉最左侧的 label，通配规则多取一个 label，均未命中时取最后一个 label
+func (l *suffixList) publicSuffix(domain string) string {
+	for start := 0; ; {
+		candidate := domain[start:]
+		kind := l.rules[candidate]
+		if kind&pslException != 0 {
+			_, suffix, _ := strings.Cut(candidate, ".")
+			return suffix
+		}
+		if kind&pslNormal != 0 {
+			return candidate
+		}
+		dot := strings.IndexByte(candidate, '.')
+		if dot < 0 {
+			return candidate
+		}
+		if l.rules[candidate[dot+1:]]&pslWildcard != 0 {
+			return candidate
+		}
+		start += dot + 1
+	}
+}
+
+// registrableDomain 可注册域名（eTLD+1），如 a.b.foo.com.cn 为 foo.com.cn，x.y.github.io 为 y.github.io；
+// 域名本身是公共后缀时返回空字符串，返回的是规范化后的域名
+func registrableDomain(domain string) string {
+	domain = normalizeDomain(domain)
+	var suffix string
+	if publicSuffixes != nil {
+		suffix = publicSuffixes.publicSuffix(domain)
+	} else {
+		suffix, _ = publicsuffix.PublicSuffix(domain)
+	}
+	if len(suffix) >= len(domain) {
+		return ""
+	}
+	i := strings.LastIndexByte(domain[:len(domain)-len(suffix)-1], '.')
+	return domain[i+1:]
+}
+
+// loadPublicSuffixList 启动时加载本地公共后缀列表，文件不存在时使用内置列表
+func loadPublicSuffixList(file string) {
+	if file == "" {
+		file = defaultPublicSuffixFile
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		fmt.Printf("Public suffix list: built-in (%s)\n", publicsuffix.List.String())
+		return
+	}
+	list, err := loadSuffixListFile(file)
+	if err != nil {
+		log.Printf("加载公共后缀列表 %s 失败，使用内置列表: %v\n", file, err)
+		return
+	}
+	publicSuffixes = list
+	fmt.Printf("Public suffix list: %d rules from %s\n", len(list.rules), file)
+}
+
+var (
+	pslSourceFile string
+	pslTargetFile string
+)
+
+func init() {
+	updatePSLCmd := &cobra.Command{
+		Use:   "update-psl",
+		Short: "从本地文件更新公共后缀列表",
+		Long:  "校验从 publicsuffix.org 下载的 public_suffix_list.dat，并复制到 public_suffix_file 指定的位置，重启后生效",
+		Run: func(cmd *cobra.Command, args []string) {
+			content, err := os.ReadFile(pslSourceFile)
+			if err != nil {
+				log.Fatalf("读取公共后缀列表失败: %v", err)
+			}
+			list, err := parseSuffixList(bytes.NewReader(content))
+			if err != nil {
+				log.Fatalf("公共后缀列表格式错误: %v", err)
+			}
+			if err := os.WriteFile(pslTargetFile, content, 0644); err != nil {
+				log.Fatalf("写入公共后缀列表失败: %v", err)
+			}
+			fmt.Printf("更新完成: %d 条规则写入 %s\n", len(list.rules), pslTargetFile)
+		},
+	}
+	updatePSLCmd.Flags().StringVarP(&pslSourceFile, "file", "f", "", "下载的 public_suffix_list.dat")
+	updatePSLCmd.Flags().StringVarP(&pslTargetFile, "output", "o", defaultPublicSuffixFile, "写入位置，与配置中的 public_suffix_file 一致")
+	updatePSLCmd.MarkFlagRequired("file")
+	rootCmd.AddCommand(updatePSLCmd)
+}
@@ -10,18 +10,42 @@ import (
 	"log"
 	"os"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// 输出格式中的附加字段，不对应输入字段
+const (
+	outputMatchedName  = 20001 // 命中的域名（请求域名或 cname 链中的某一项）
+	outputRuleCategory = 20002 // 命中规则的 category
+	outputRuleSource   = 20003 // 命中规则的 source
+	outputRuleID       = 20004 // 命中规则的 id
+
+	outputRegistrableDomain = 20005 // 请求域名的可注册域名（eTLD+1）
+)
+
+// outputExtraFields 附加字段在 output_format 中的名称
+var outputExtraFields = map[string]int{
+	"matched_name":  outputMatchedName,
+	"rule_category": outputRuleCategory,
+	"rule_source":   outputRuleSource,
+	"rule_id":       outputRuleID,
+
+	"registrable_domain": outputRegistrableDomain,
+}
+
 func transferFormat(inputFormatStr string, outputFormatStr string) []int {
 	var format []int
 	inputFormat := strings.Split(inputFormatStr, ",")
 	outputFormat := strings.Split(outputFormatStr, ",")
 
 	for _, outSeg := range outputFormat {
+		//命中的域名及规则元数据，不对应输入字段
+		if field, ok := outputExtraFields[outSeg]; ok {
+			format = append(format, field)
+			continue
+		}
 
 		for index, inputSeg := range inputFormat {
 			if inputSeg == outSeg {
@@ -53,78 +77,6 @@ func transferFormat(inputFormatStr string, outputFormatStr string) []int {
 	return format
 }
 
-func IPListToCache(filterListFiles []string) (*sync.Map, *TrieNode, int) {
-	var (
-		v4Counter     int
-		v6Counter     int
-		ipfileterMode int
-
-		listMap sync.Map
-	)
-	trie := NewTrieNode()
-
-	if len(filterListFiles) == 0 {
-		return &listMap, trie, 0
-	}
-
-	for _, file := range filterListFiles {
-
-		// 打开文件
-		fileHandle, err := os.Open(file)
-		if err != nil {
-			fmt.Printf("Error opening file %s: %v\n", file, err)
-			continue
-		}
-		defer fileHandle.Close() // 确保文件句柄被关闭
-
-		// 逐行扫描文件内容
-		scanner := bufio.NewScanner(fileHandle)
-		for scanner.Scan() {
-
-			line := strings.TrimSpace(scanner.Text())
-
-			if line == "" {
-				continue // 跳过空行
-			}
-
-			if strings.Contains(line, ":") {
-				trie.v6Insert(line)
-				v6Counter++
-			} else {
-				ips, err := parseIPFormat(scanner.Text())
-				if err != nil {
-					panic(fmt.Sprintf("Error parsing IP format: %v\n", err))
-				}
-
-				// 将 IP 存入 sync.Map
-				for _, ip := range ips {
-					listMap.Store(ip, struct{}{}) // 使用空结构体减少内存占用
-					v4Counter++
-				}
-			}
-
-		}
-
-		// 检查扫描错误
-		if err := scanner.Err(); err != nil {
-			fmt.Printf("Error reading file %s: %v\n", file, err)
-		}
-	}
-
-	fmt.Printf("Read %d v4IP and %d v6IP rules from files: %s\n", v4Counter, v6Counter, strings.Join(filterListFiles, ", "))
-
-	if v4Counter > 0 {
-		if v6Counter > 0 {
-			ipfileterMode = 3
-		} else {
-			ipfileterMode = 2
-		}
-		ipfileterMode = 1
-	}
-
-	return &listMap, trie, ipfileterMode
-}
-
 func IPListToTxt(FilterListFile []string) {
 	counter := 0
 
@@ -172,42 +124,56 @@ func IPListToTxt(FilterListFile []string) {
 
 // DomainListToTree 读取文件中的域名并构建 Trie 树
 func DomainListToTree(filenames []string) *TrieNode {
-	counter := 0
-	trie := NewTrieNode()
+	trie, counter := domainRulesToTree(filenames, false)
+
+	fmt.Printf("Read %d domain rules from files: %s\n", counter, strings.Join(filenames, ", "))
+
+	return trie
+}
 
-	if len(filenames) == 0 {
-		return trie
+// domainRulesToTree 读取域名规则文件，普通域名插入 Trie，
+// 正则/通配符规则合并为一个匹配器挂在根节点上，返回有效的规则行数
+func domainRulesToTree(filenames []string, exactDefault bool) (*TrieNode, int) {
+	trie, stats := domainRuleFilesToTree(filenames, exactDefault)
+	counter := 0
+	for _, stat := range stats {
+		counter += stat.Accepted
 	}
+	return trie, counter
+}
+
+// domainRuleFilesToTree 按各文件的格式（见 splitRuleFileSpec、detectRuleFormat）加载域名规则，返回每个文件的统计
+func domainRuleFilesToTree(filenames []string, exactDefault bool) (*TrieNode, []ruleFileStat) {
+	trie := NewTrieNode()
+	var patterns []domainPattern
+	var stats []ruleFileStat
 
 	for _, file := range filenames {
-		// 打开文件
-		fileHandle, err := os.Open(file)
+		expiry := newRuleExpiry(ruleFilePath(file))
+		stat, err := loadDomainRuleFile(file, func(line string, source string) ruleLoadResult {
+			rule, meta := splitRuleMeta(line, source)
+			if result := expiry.check(meta); result != ruleKept {
+				return result
+			}
+			if expr, ok := parseDomainPattern(rule); ok {
+				patterns = append(patterns, domainPattern{expr: expr, source: source, meta: meta})
+			} else {
+				trie.InsertRuleMeta(rule, exactDefault, meta)
+			}
+			return ruleKept
+		})
 		if err != nil {
-			fmt.Printf("Error opening file %s: %v\n", file, err)
+			fmt.Printf("Error reading file %s: %v\n", stat.File, err)
 			continue
 		}
-		defer fileHandle.Close() // 确保文件句柄被正确关闭
-
-		// 扫描文件内容
-		scanner := bufio.NewScanner(fileHandle)
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" {
-				continue // 跳过空行
-			}
-			trie.Insert(line)
-			counter++
-		}
-
-		// 检查扫描错误
-		if err := scanner.Err(); err != nil {
-			fmt.Printf("Error reading file %s: %v\n", file, err)
-		}
+		stat.nextExpiry = expiry.next
+		fmt.Printf("Loaded %s (%s): %d lines accepted, %d skipped, %d expired\n", stat.File, stat.Format, stat.Accepted, stat.Skipped, stat.Expired)
+		stats = append(stats, stat)
 	}
 
-	fmt.Printf("Read %d domain rules from files: %s\n", counter, strings.Join(filenames, ", "))
+	trie.patterns = compilePatterns(patterns)
 
-	return trie
+	return trie, stats
 }
 
 func fileExists(filename string) bool {
@@ -225,6 +191,20 @@ func (T *Tasks) configValid() (bool, error) {
 		return invalid, fmt.Errorf("%s not exsit", T.InputDir)
 	}
 
+	for _, filename := range append(T.ExcludeDomainRuler, T.ExcludeIpRuler...) {
+		if !fileExists(ruleFilePath(filename)) {
+			return invalid, fmt.Errorf("%s not exsit", filename)
+		}
+	}
+
+	for _, ruleSet := range T.RuleSets {
+		for _, filename := range append(ruleSet.DomainRuler, ruleSet.IpRuler...) {
+			if !fileExists(ruleFilePath(filename)) {
+				return invalid, fmt.Errorf("%s not exsit", filename)
+			}
+		}
+	}
+
 	for _, taskInfo := range T.TaskInfos {
 		if !taskInfo.Enable {
 			continue
@@ -235,12 +215,16 @@ func (T *Tasks) configValid() (bool, error) {
 			}
 		}
 		for _, filename := range taskInfo.FilterDomainRuler {
-			if !fileExists(filename) {
+			if !fileExists(ruleFilePath(filename)) {
 				return invalid, fmt.Errorf("%s not exsit", filename)
 			}
 		}
-		for _, filename := range taskInfo.FilterIpRuler {
-			if !fileExists(filename) {
+		ruleFiles := append([]string{}, taskInfo.FilterIpRuler...)
+		ruleFiles = append(ruleFiles, taskInfo.FilterDNSServerRuler...)
+		ruleFiles = append(ruleFiles, taskInfo.ExcludeDomainRuler...)
+		ruleFiles = append(ruleFiles, taskInfo.ExcludeIpRuler...)
+		for _, filename := range ruleFiles {
+			if !fileExists(ruleFilePath(filename)) {
 				return invalid, fmt.Errorf("%s not exsit", filename)
 			}
 		}
@@ -290,6 +274,8 @@ func (t *TaskInfo) getTaskType() int {
 
 func newTasks() *Tasks {
 	tasks := readConf("./config.yaml")
+	//规则清单中的 HTTP(S) 地址先获取到本地缓存，之后按文件校验和加载
+	tasks.initRuleSources()
 
 	if ok, err := tasks.configValid(); !ok {
 		fmt.Printf("配置文件校验错误: %s\n", err.Error())
@@ -300,26 +286,29 @@ func newTasks() *Tasks {
 
 	tasks.NewFilePath = make(chan string, tasks.AnalyzeThreads*200)
 	tasks.hostIP = GetIPAddress(tasks.EthName)
-	tasks.TempResultMap = make(map[string]*bytes.Buffer)
+	// 每个分析线程各有 split_workers 个 worker，默认 1 个，避免 analyze_threads 的平方个 goroutine
+	if tasks.SplitWorkers <= 0 {
+		tasks.SplitWorkers = 1
+	}
+	if tasks.splitChunkSize = parseSize(tasks.SplitChunkSizeString); tasks.splitChunkSize <= 0 {
+		tasks.splitChunkSize = defaultChunkSize
+	}
 	tasks.RunStatus.TaskMatchDetails = make(map[string]int)
+	tasks.RunStatus.TaskExcludeDetails = make(map[string]int)
+	tasks.RunStatus.RejectReasons = make(map[string]int)
+	tasks.RunStatus.RejectFileDetails = make(map[string]map[string]int)
 
-	for i, v := range strings.Split(tasks.InputFormat, ",") {
-		switch v {
-		case "1":
-			tasks.RequestIPIndex = i
-		case "3":
-			tasks.DNSServerIndex = i
-		case "7":
-			tasks.RequestTypeIndex = i
-		case "6":
-			tasks.DomainIndex = i
-		case "14":
-			tasks.RCodeIndex = i
-		case "15":
-			tasks.ResultIndex = i
-		default:
+	parser, err := newRecordParser(tasks.InputFormat, tasks.InputDelimiter, tasks.InputEscape)
+	if err != nil {
+		fmt.Printf("配置文件校验错误: %s\n", err.Error())
+		os.Exit(1)
+	}
+	tasks.parser = parser
+	tasks.logIndex = parser.logIndex
 
-		}
+	if parser.eventTime, err = newEventTimeParser(tasks.EventTimeLayout, tasks.EventTimeZone); err != nil {
+		fmt.Printf("配置文件校验错误: %s\n", err.Error())
+		os.Exit(1)
 	}
 
 	//初始化rocksdb
@@ -357,6 +346,9 @@ func newTasks() *Tasks {
 
 	}
 
+	loadPublicSuffixList(tasks.PublicSuffixFile)
+	tasks.loadRuleSets()
+
 	for taskName, task := range tasks.TaskInfos {
 		task.TaskID++
 
@@ -374,31 +366,32 @@ func newTasks() *Tasks {
 
 		task.outPreFileName = make(map[int]*fileInfo)
 
-		if task.ForceDomainMode {
-			if !strings.HasPrefix(task.ForceDomainSql, "select") {
-				log.Fatalf("only support select operation")
-			}
-			task.queryAndWriteDomains(task.ForceDomainList)
+		//数据库规则源同步一次后加入过滤清单
+		if err := task.initSQLSources(taskName); err != nil {
+			log.Fatalf("task %s: %v", taskName, err)
 		}
+		//全局排除清单对所有任务生效，与任务自身的排除清单一起加载和刷新
+		task.ExcludeIpRuler = append(append([]string{}, tasks.ExcludeIpRuler...), task.ExcludeIpRuler...)
+		task.ExcludeDomainRuler = append(append([]string{}, tasks.ExcludeDomainRuler...), task.ExcludeDomainRuler...)
 		task.NewMatchRule(task.FilterIpRuler, task.FilterDomainRuler)
+		if err := task.compileMatch(tasks.ruleSets, tasks.logIndex); err != nil {
+			log.Fatalf("task %s: %v", taskName, err)
+		}
 
 		if task.FileMaxSizeString != "" {
-			unit := task.FileMaxSizeString[len(task.FileMaxSizeString)-1:]
-			value, _ := strconv.Atoi(task.FileMaxSizeString[:len(task.FileMaxSizeString)-1])
-			switch strings.ToLower(unit) {
-			case "g":
-				task.FileMaxSize = value * 1 << 30
-			case "m":
-				task.FileMaxSize = value * 1 << 20
-			case "k":
-				task.FileMaxSize = value * 1 << 10
-			}
+			task.FileMaxSize = parseSize(task.FileMaxSizeString)
 		} else {
 
 			//默认200M
 			task.FileMaxSize = 200 * 1 << 20
 		}
 
+		if task.EventTimeWindow > 0 {
+			if tasks.ResponseTimeIndex < 0 {
+				log.Fatalf("task %s: event_time_window requires field 12 in input_format", taskName)
+			}
+		}
+
 		if task.FileMaxTime == 0*time.Second {
 			task.FileMaxTime = 99999 * time.Hour
 		}
@@ -437,6 +430,9 @@ func newTasks() *Tasks {
 
 	}
 
+	//所有任务的规则集合并为组合索引，每行日志每个字段只查找一次
+	tasks.initRuleIndex()
+
 	return tasks
 }
 
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// 默认的字段分隔符
+const defaultDelimiter = '|'
+
+var errFieldCount = errors.New("field count mismatch")
+
+// RecordParser 按 input_format 解析单行日志
+type RecordParser struct {
+	delimiter  byte
+	escape     byte // 0 表示不启用转义
+	fieldCount int  // input_format 中声明的字段数
+	logIndex
+
+	// 响应时间解析器，只有按事件时间输出的任务使用，见 filterTarget.output
+	eventTime *eventTimeParser
+}
+
+// Record 单条日志记录。字段是对原始行的零拷贝视图，只在下一次 Parse 之前有效，
+// 需要跨行保存时必须使用 strings.Clone 复制。
+type Record struct {
+	line    []byte
+	fields  []string
+	scratch []byte // 含转义符时存放反转义后的内容
+	parser  *RecordParser
+
+	eventTime       time.Time
+	eventTimeParsed bool
+	eventTimeOK     bool
+
+	// 当前任务匹配表达式中第一个命中的规则，每个任务求值前清空
+	matched matchedRule
+
+	// 组合索引及各字段命中的规则集，每行解析时清空，字段第一次用到时查找
+	index     *ruleIndex
+	indexBits [indexFieldCount]ruleSetBits
+	indexHits [indexFieldCount][]indexHit
+	indexDone uint8
+}
+
+// newRecordParser 根据输入格式、分隔符和转义符构造解析器
+func newRecordParser(inputFormat string, delimiter string, escape string) (*RecordParser, error) {
+	p := &RecordParser{delimiter: defaultDelimiter}
+
+	if len(delimiter) > 1 || len(escape) > 1 {
+		return nil, fmt.Errorf("input_delimiter and input_escape must be a single byte")
+	}
+	if delimiter != "" {
+		p.delimiter = delimiter[0]
+	}
+	if escape != "" {
+		p.escape = escape[0]
+		if p.escape == p.delimiter {
+			return nil, fmt.Errorf("input_escape can't be the same as input_delimiter")
+		}
+	}
+
+	codes := strings.Split(inputFormat, ",")
+	p.fieldCount = len(codes)
+	p.logIndex = newLogIndex(codes)
+
+	return p, nil
+}
+
+// newLogIndex 计算各字段在日志中的位置，不存在的字段为 -1
+func newLogIndex(codes []string) logIndex {
+	index := logIndex{
+		RequestIPIndex:    -1,
+		DNSServerIndex:    -1,
+		RequestTypeIndex:  -1,
+		RCodeIndex:        -1,
+		DomainIndex:       -1,
+		ResultIndex:       -1,
+		CNAMEIndex:        -1,
+		ResponseTimeIndex: -1,
+	}
+
+	for i, v := range codes {
+		switch strings.TrimSpace(v) {
+		case "1":
+			index.RequestIPIndex = i
+		case "3":
+			index.DNSServerIndex = i
+		case "7":
+			index.RequestTypeIndex = i
+		case "6":
+			index.DomainIndex = i
+		case "12":
+			index.ResponseTimeIndex = i
+		case "14":
+			index.RCodeIndex = i
+		case "15":
+			index.ResultIndex = i
+		case "19":
+			index.CNAMEIndex = i
+		default:
+
+		}
+	}
+	return index
+}
+
+// NewRecord 创建可复用的记录
+func (p *RecordParser) NewRecord() *Record {
+	return &Record{
+		fields: make([]string, 0, p.fieldCount+1),
+		parser: p,
+	}
+}
+
+// Parse 解析一行日志到 rec 中，字段数与 input_format 不一致时返回错误。
+// 行尾多一个分隔符（最后一个字段为空）视为合法。line 在下一次 Parse 之前不能被修改。
+func (p *RecordParser) Parse(line []byte, rec *Record) error {
+	rec.line = line
+	rec.fields = rec.fields[:0]
+	rec.eventTimeParsed = false
+	rec.indexDone = 0
+
+	if p.escape == 0 || bytes.IndexByte(line, p.escape) < 0 {
+		start := 0
+		for i, c := range line {
+			if c == p.delimiter {
+				rec.fields = append(rec.fields, bytesView(line[start:i]))
+				start = i + 1
+			}
+		}
+		rec.fields = append(rec.fields, bytesView(line[start:]))
+	} else {
+		rec.fields = p.splitEscaped(line, rec)
+	}
+
+	n := len(rec.fields)
+	if n == p.fieldCount+1 && rec.fields[n-1] == "" {
+		rec.fields = rec.fields[:n-1]
+		n--
+	}
+	if n != p.fieldCount {
+		return fmt.Errorf("%w: expect %d, got %d", errFieldCount, p.fieldCount, n)
+	}
+	return nil
+}
+
+// splitEscaped 处理带转义符的行，转义符后的字符按字面量处理
+func (p *RecordParser) splitEscaped(line []byte, rec *Record) []string {
+	// 预留足够容量，保证写入过程中不会扩容，已生成的字段视图始终有效
+	if cap(rec.scratch) < len(line) {
+		rec.scratch = make([]byte, 0, len(line))
+	}
+	scratch := rec.scratch[:0]
+	fields := rec.fields
+
+	start := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == p.escape && i+1 < len(line):
+			i++
+			scratch = append(scratch, line[i])
+		case c == p.delimiter:
+			fields = append(fields, bytesView(scratch[start:]))
+			start = len(scratch)
+		default:
+			scratch = append(scratch, c)
+		}
+	}
+	rec.scratch = scratch
+	return append(fields, bytesView(scratch[start:]))
+}
+
+// bytesView 零拷贝地将 []byte 转为 string，仅用于热点路径上的临时查询，
+// 调用方必须保证 b 在返回的字符串使用期间不被修改。
+func bytesView(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(&b[0], len(b))
+}
+
+// Line 返回原始日志行
+func (r *Record) Line() []byte {
+	return r.line
+}
+
+// Fields 返回全部字段，仅在下一次 Parse 之前有效
+func (r *Record) Fields() []string {
+	return r.fields
+}
+
+// Field 按位置返回字段，越界返回空串
+func (r *Record) Field(i int) string {
+	if i < 0 || i >= len(r.fields) {
+		return ""
+	}
+	return r.fields[i]
+}
+
+// IsQuery 是否为请求日志（首字段为 q），过滤时只处理响应日志
+func (r *Record) IsQuery() bool {
+	return r.Field(0) == "q"
+}
+
+// RequestIP 请求IP（字段 1）
+func (r *Record) RequestIP() string {
+	return r.Field(r.parser.RequestIPIndex)
+}
+
+// RequestAddr 解析后的请求IP
+func (r *Record) RequestAddr() (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(r.RequestIP())
+	return addr, err == nil
+}
+
+// DNSServer DNS服务IP（字段 3）
+func (r *Record) DNSServer() string {
+	return r.Field(r.parser.DNSServerIndex)
+}
+
+// Domain 请求域名（字段 6）
+func (r *Record) Domain() string {
+	return r.Field(r.parser.DomainIndex)
+}
+
+// QType 请求类型（字段 7）
+func (r *Record) QType() string {
+	return r.Field(r.parser.RequestTypeIndex)
+}
+
+// QTypeCode 数字形式的请求类型
+func (r *Record) QTypeCode() (int, bool) {
+	code, err := strconv.Atoi(r.QType())
+	return code, err == nil
+}
+
+// ResponseTime 响应时间（字段 12）
+func (r *Record) ResponseTime() string {
+	return r.Field(r.parser.ResponseTimeIndex)
+}
+
+// RCode 响应编码（字段 14）
+func (r *Record) RCode() string {
+	return r.Field(r.parser.RCodeIndex)
+}
+
+// RCodeCode 数字形式的响应编码
+func (r *Record) RCodeCode() (int, bool) {
+	code, err := strconv.Atoi(r.RCode())
+	return code, err == nil
+}
+
+// Result 响应内容（字段 15），多个地址以 ; 分隔
+func (r *Record) Result() string {
+	return r.Field(r.parser.ResultIndex)
+}
+
+// CNAME cname 链（字段 19）
+func (r *Record) CNAME() string {
+	return r.Field(r.parser.CNAMEIndex)
+}
+
+// Validate 校验过滤时依赖的字段，返回拒绝原因，合法时返回空串
+func (p *RecordParser) Validate(rec *Record) string {
+	if p.RequestIPIndex >= 0 {
+		if _, ok := rec.RequestAddr(); !ok {
+			return rejectBadIP
+		}
+	}
+	if p.DomainIndex >= 0 && rec.Domain() == "" {
+		return rejectEmptyQName
+	}
+	if p.RequestTypeIndex >= 0 {
+		if _, ok := parseQType(rec.QType()); !ok {
+			return rejectUnknownQType
+		}
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// 异常日志的拒绝原因，同时用于统计和 reject 文件
+const (
+	rejectFieldCount   = "field_count"
+	rejectBadIP        = "bad_ip"
+	rejectEmptyQName   = "empty_qname"
+	rejectUnknownQType = "unknown_qtype"
+)
+
+// 最多保留多少个输入文件的拒绝统计，避免在线模式下无限增长
+const maxRejectFiles = 1000
+
+// rejectCounter 单个输入文件的拒绝统计
+type rejectCounter struct {
+	total   int
+	reasons map[string]int
+	lines   *bytes.Buffer // 为 nil 时不记录原始日志
+}
+
+func (T *Tasks) newRejectCounter() *rejectCounter {
+	rc := &rejectCounter{reasons: make(map[string]int)}
+	if T.RejectDir != "" {
+		rc.lines = new(bytes.Buffer)
+	}
+	return rc
+}
+
+// add 记录一条被拒绝的日志
+func (rc *rejectCounter) add(reason string, srcFileName string, line []byte) {
+	rc.total++
+	rc.reasons[reason]++
+	if rc.lines != nil {
+		rc.lines.WriteString(reason)
+		rc.lines.WriteByte('|')
+		rc.lines.WriteString(srcFileName)
+		rc.lines.WriteByte('|')
+		rc.lines.Write(line)
+		rc.lines.WriteByte('\n')
+	}
+}
+
+// rejectReason 将解析错误转换为拒绝原因
+func rejectReason(err error) string {
+	if errors.Is(err, errFieldCount) {
+		return rejectFieldCount
+	}
+	return err.Error()
+}
+
+// recordRejects 汇总单个文件的拒绝统计到 RunStatus，并写入当日的 reject 文件。
+// 同一文件再次分析（如在线模式下文件追加）时累加到该文件已有的统计
+func (T *Tasks) recordRejects(srcFileName string, rc *rejectCounter) {
+	if rc.total == 0 {
+		return
+	}
+
+	T.statusLock.Lock()
+	T.RejectedRecords += rc.total
+	for reason, num := range rc.reasons {
+		T.RejectReasons[reason] += num
+	}
+	details, ok := T.RejectFileDetails[srcFileName]
+	if !ok {
+		details = make(map[string]int)
+		T.RejectFileDetails[srcFileName] = details
+		T.rejectFileOrder = append(T.rejectFileOrder, srcFileName)
+		if len(T.rejectFileOrder) > maxRejectFiles {
+			delete(T.RejectFileDetails, T.rejectFileOrder[0])
+			T.rejectFileOrder = T.rejectFileOrder[1:]
+		}
+	}
+	for reason, num := range rc.reasons {
+		details[reason] += num
+	}
+	T.statusLock.Unlock()
+
+	if rc.lines == nil {
+		return
+	}
+
+	if _, err := os.Stat(T.RejectDir); os.IsNotExist(err) {
+		if err = os.MkdirAll(T.RejectDir, 0755); err != nil {
+			log.Printf("[Reject] 创建目录失败: %v\n", err)
+			return
+		}
+	}
+
+	rejectFile := path.Join(T.RejectDir, fmt.Sprintf("reject_%s.log", time.Now().Format("20060102")))
+
+	T.rejectLock.Lock()
+	T.WriteLog(rejectFile, rc.lines)
+	T.rejectLock.Unlock()
+}
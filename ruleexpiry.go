@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// expires= 支持的时间格式，不带时区的按本地时间
+var ruleExpiresLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseRuleExpires 解析规则的到期时间，如 2026-11-01、2026-11-01 08:00:00、2026-11-01T08:00:00+08:00
+func parseRuleExpires(value string) (time.Time, error) {
+	for _, layout := range ruleExpiresLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// parseRuleTTL 解析规则的有效期，支持 30d 和 Go 的时长格式（72h、90m）
+func parseRuleTTL(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid ttl %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q", value)
+	}
+	return d, nil
+}
+
+// expiresAt 规则的到期时间，ttl 从规则文件的修改时间起算，同时指定时取较早的一个；零值表示不过期
+func (m *ruleMeta) expiresAt(modTime time.Time) time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	at := m.expires
+	if m.ttl > 0 {
+		if t := modTime.Add(m.ttl); at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+	return at
+}
+
+// managedRuleFiles 规则源缓存和数据库同步的清单，每次同步都会改写，修改时间不能作为 ttl 的起算时间
+var managedRuleFiles sync.Map
+
+// markManagedRuleFile 记录由程序改写的规则文件，其中带 ttl 的条目不加载，应使用 expires
+func markManagedRuleFile(file string) {
+	managedRuleFiles.Store(file, true)
+}
+
+func isManagedRuleFile(file string) bool {
+	_, ok := managedRuleFiles.Load(file)
+	return ok
+}
+
+// ruleExpiry 加载一个规则文件时过滤已到期的条目，并记录未到期条目中最早的到期时间
+type ruleExpiry struct {
+	file    string
+	now     time.Time
+	modTime time.Time
+	next    time.Time
+	managed bool // 见 managedRuleFiles
+	warned  bool
+}
+
+// newRuleExpiry 以文件的修改时间作为 ttl 的起算时间
+func newRuleExpiry(file string) *ruleExpiry {
+	e := &ruleExpiry{file: file, now: time.Now(), managed: isManagedRuleFile(file)}
+	if info, err := os.Stat(file); err == nil {
+		e.modTime = info.ModTime()
+	}
+	return e
+}
+
+// check 条目是否仍然有效，expires / ttl 无法解析的条目不加载，规则源和数据库同步的清单中带 ttl 的条目也不加载
+func (e *ruleExpiry) check(meta *ruleMeta) ruleLoadResult {
+	if meta != nil && meta.invalid {
+		return ruleInvalid
+	}
+	if e.managed && meta != nil && meta.ttl > 0 {
+		if !e.warned {
+			fmt.Printf("ttl is not supported in %s, it is rewritten on every sync; entries with ttl skipped, use expires instead\n", e.file)
+			e.warned = true
+		}
+		return ruleInvalid
+	}
+	at := meta.expiresAt(e.modTime)
+	if at.IsZero() {
+		return ruleKept
+	}
+	if !at.After(e.now) {
+		return ruleExpired
+	}
+	e.next = earlierExpiry(e.next, at)
+	return ruleKept
+}
+
+// earlierExpiry 两个到期时间中较早的一个，零值表示不过期
+func earlierExpiry(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// nextExpiry 目标引用的规则集中最早的到期时间
+func (t *ruleWatchTarget) nextExpiry() time.Time {
+	var next time.Time
+	for _, r := range t.rules {
+		next = earlierExpiry(next, r.load().nextExpiry)
+	}
+	return next
+}
+
+// scheduleRuleExpiry 按全部规则中最早的到期时间设置定时器，规则加载或刷新后重新计算
+func (T *Tasks) scheduleRuleExpiry() {
+	var next time.Time
+	for _, target := range T.ruleTargets {
+		next = earlierExpiry(next, target.nextExpiry())
+	}
+
+	T.expiryLock.Lock()
+	defer T.expiryLock.Unlock()
+	if T.expiryTimer != nil {
+		T.expiryTimer.Stop()
+		T.expiryTimer = nil
+	}
+	if !next.IsZero() {
+		T.expiryTimer = time.AfterFunc(time.Until(next), T.expireRules)
+	}
+}
+
+// expireRules 重新加载有条目到期的任务或规则集，到期的条目在加载时跳过，不再命中。
+// 刷新后由 refreshRules 设置下一次的定时器，同一目标只由一个线程重新加载
+func (T *Tasks) expireRules() {
+	now := time.Now()
+	expired := false
+	for _, target := range T.ruleTargets {
+		next := target.nextExpiry()
+		if next.IsZero() || next.After(now) {
+			continue
+		}
+		expired = true
+		if !target.expiring.CompareAndSwap(false, true) {
+			continue
+		}
+		log.Printf("[rule expiry] %s: entries expired at %s, reloading\n", target.name, next.Format(time.DateTime))
+		target.refresh()
+		target.expiring.Store(false)
+	}
+	//定时器早于到期时间触发时重新计时
+	if !expired {
+		T.scheduleRuleExpiry()
+	}
+}
+
+// ruleExpiryEntry 即将到期或已到期的规则条目
+type ruleExpiryEntry struct {
+	rule    string
+	source  string
+	expires time.Time
+}
+
+// scanRuleExpiry 读取规则文件中带 expires / ttl 的条目，ip 文件逐行读取，域名文件按格式解析
+func scanRuleExpiry(file string, isIP bool) ([]ruleExpiryEntry, error) {
+	var entries []ruleExpiryEntry
+	expiry := newRuleExpiry(ruleFilePath(file))
+	add := func(line string, source string) ruleLoadResult {
+		rule, meta := splitRuleMeta(line, source)
+		if expiry.check(meta) == ruleInvalid {
+			return ruleInvalid
+		}
+		if at := meta.expiresAt(expiry.modTime); !at.IsZero() {
+			entries = append(entries, ruleExpiryEntry{rule: rule, source: source, expires: at})
+		}
+		return ruleKept
+	}
+
+	if !isIP {
+		_, err := loadDomainRuleFile(file, add)
+		return entries, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			add(line, fmt.Sprintf("%s:%d", file, lineNum))
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// ruleFiles 配置中引用的全部 IP 和域名规则文件，去重后按名称排序
+func (T *Tasks) ruleFiles() (ipFiles []string, domainFiles []string) {
+	ips, domains := make(map[string]bool), make(map[string]bool)
+	addAll := func(set map[string]bool, files []string) {
+		for _, file := range files {
+			set[file] = true
+		}
+	}
+	addAll(ips, T.ExcludeIpRuler)
+	addAll(domains, T.ExcludeDomainRuler)
+	for _, task := range T.TaskInfos {
+		addAll(ips, task.FilterIpRuler)
+		addAll(ips, task.FilterDNSServerRuler)
+		addAll(ips, task.ExcludeIpRuler)
+		addAll(domains, task.FilterDomainRuler)
+		addAll(domains, task.ExcludeDomainRuler)
+	}
+	for _, info := range T.RuleSets {
+		addAll(ips, info.IpRuler)
+		addAll(domains, info.DomainRuler)
+	}
+	sorted := func(set map[string]bool) []string {
+		files := make([]string, 0, len(set))
+		for file := range set {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		return files
+	}
+	return sorted(ips), sorted(domains)
+}
+
+var (
+	expiryConfigFile string
+	expiryWithin     string
+)
+
+func init() {
+	ruleExpiryCmd := &cobra.Command{
+		Use:   "rule-expiry",
+		Short: "列出即将到期或已到期的规则",
+		Long:  "读取配置中引用的全部规则文件，按到期时间列出指定时间内到期（expires / ttl）和已经到期的条目",
+		Run: func(cmd *cobra.Command, args []string) {
+			within, err := parseRuleTTL(expiryWithin)
+			if err != nil {
+				log.Fatalf("时间范围格式错误: %v", err)
+			}
+			tasks := readConf(expiryConfigFile)
+			tasks.resolveRuleSources()
+
+			var entries []ruleExpiryEntry
+			scan := func(files []string, isIP bool) {
+				for _, file := range files {
+					found, err := scanRuleExpiry(file, isIP)
+					if err != nil {
+						fmt.Printf("Error reading file %s: %v\n", file, err)
+						continue
+					}
+					entries = append(entries, found...)
+				}
+			}
+			ipFiles, domainFiles := tasks.ruleFiles()
+			scan(ipFiles, true)
+			scan(domainFiles, false)
+
+			now := time.Now()
+			deadline := now.Add(within)
+			sort.SliceStable(entries, func(i, j int) bool { return entries[i].expires.Before(entries[j].expires) })
+			expired, expiring := 0, 0
+			for _, entry := range entries {
+				if entry.expires.After(deadline) {
+					break
+				}
+				status := "expiring"
+				if !entry.expires.After(now) {
+					status = "expired"
+					expired++
+				} else {
+					expiring++
+				}
+				fmt.Printf("%-8s  %s  %s  %s\n", status, entry.expires.Format(time.DateTime), entry.rule, entry.source)
+			}
+			fmt.Printf("%d expired, %d expiring within %s\n", expired, expiring, expiryWithin)
+		},
+	}
+	ruleExpiryCmd.Flags().StringVarP(&expiryConfigFile, "config", "c", "./config.yaml", "配置文件")
+	ruleExpiryCmd.Flags().StringVarP(&expiryWithin, "within", "w", "7d", "列出该时间内到期的条目，如 7d、12h")
+	rootCmd.AddCommand(ruleExpiryCmd)
+}
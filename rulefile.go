@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 域名规则文件的格式，可以在 filter_domain_ruler 中以 格式:路径 声明，未声明时按内容识别
+const (
+	ruleFormatList    = "list"    // 每行一条规则，见 parseDomainRule 和 parseDomainPattern
+	ruleFormatHosts   = "hosts"   // 0.0.0.0 evil.com
+	ruleFormatAdBlock = "adblock" // ||evil.com^
+	ruleFormatRPZ     = "rpz"     // RPZ 区域文件，只取 QNAME 触发器
+)
+
+// ruleLoadResult 加载一条规则的结果
+type ruleLoadResult int
+
+const (
+	ruleKept    ruleLoadResult = iota
+	ruleExpired                // expires / ttl 已到期
+	ruleInvalid                // expires / ttl 无法解析，按无法解析的行计数
+)
+
+// ruleFileStat 单个规则文件的加载结果，skipped 为无法解析或不支持的行（含 expires / ttl 无效的行），不含空行和注释
+type ruleFileStat struct {
+	File     string `json:"file"`
+	Format   string `json:"format"`
+	Accepted int    `json:"accepted"`
+	Skipped  int    `json:"skipped"`
+	Expired  int    `json:"expired"`
+
+	nextExpiry time.Time // 未到期条目中最早的到期时间
+}
+
+// splitRuleFileSpec 拆分 格式:路径，前缀不是已知格式时整体视为路径
+func splitRuleFileSpec(spec string) (string, string) {
+	if format, path, ok := strings.Cut(spec, ":"); ok {
+		switch format {
+		case ruleFormatList, ruleFormatHosts, ruleFormatAdBlock, ruleFormatRPZ:
+			return format, path
+		}
+	}
+	return "", spec
+}
+
+// ruleFilePath 规则文件的路径，去掉格式前缀
+func ruleFilePath(spec string) string {
+	_, path := splitRuleFileSpec(spec)
+	return path
+}
+
+// detectRuleFormat 按前 100 行有效内容识别格式，均无特征时为 list
+func detectRuleFormat(content []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 0; n < 100 && scanner.Scan(); {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '!' {
+			continue
+		}
+		n++
+
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "[Adblock"), strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@||"):
+			return ruleFormatAdBlock
+		case line[0] == '$':
+			return ruleFormatRPZ
+		case len(fields) >= 2 && isIPAddr(fields[0]):
+			return ruleFormatHosts
+		}
+		for _, field := range fields[1:] {
+			switch strings.ToUpper(field) {
+			case "SOA", "CNAME", "IN":
+				return ruleFormatRPZ
+			}
+		}
+	}
+	return ruleFormatList
+}
+
+func isIPAddr(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+// validRuleDomain hosts / AdBlock / RPZ 中的域名是否可以作为规则，排除通配符、路径等无法转换的写法
+func validRuleDomain(domain string) bool {
+	if domain == "" || strings.ContainsAny(domain, " \t/:*?[]|^$@#!\\=") {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleLineParser 将一行转换为规则语法，ok 为 false 表示该行被跳过，rules 为空且 ok 为 true 表示空行、注释或指令
+type ruleLineParser func(line string) (rules []string, ok bool)
+
+func newRuleLineParser(format string) ruleLineParser {
+	switch format {
+	case ruleFormatHosts:
+		return parseHostsLine
+	case ruleFormatAdBlock:
+		return parseAdBlockLine
+	case ruleFormatRPZ:
+		return (&rpzParser{}).parse
+	default:
+		return parseListLine
+	}
+}
+
+func parseListLine(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, true
+	}
+	return []string{line}, true
+}
+
+// hosts 文件中不作为规则的本机名称
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// parseHostsLine 解析 hosts 格式：地址后的每个主机名精确匹配，# 之后为注释
+func parseHostsLine(line string) ([]string, bool) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, true
+	}
+	if len(fields) < 2 || !isIPAddr(fields[0]) {
+		return nil, false
+	}
+
+	var rules []string
+	local := false
+	for _, host := range fields[1:] {
+		if hostsLocalNames[strings.ToLower(host)] {
+			local = true
+			continue
+		}
+		if validRuleDomain(host) {
+			rules = append(rules, "="+host)
+		}
+	}
+	return rules, len(rules) > 0 || local
+}
+
+// AdBlock 规则中不影响域名匹配、可以忽略的选项
+var adBlockIgnoredOptions = map[string]bool{
+	"important": true,
+	"all":       true,
+	"document":  true,
+	"doc":       true,
+}
+
+// parseAdBlockLine 解析 AdBlock 格式，只支持 ||domain^ 形式的域名规则（匹配域名及子域名），
+// ! 开头为注释，[Adblock Plus 2.0] 为文件头；例外规则（@@）、URL 规则、元素隐藏规则以及带其他选项的规则跳过
+func parseAdBlockLine(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' {
+		return nil, true
+	}
+	if !strings.HasPrefix(line, "||") {
+		return nil, false
+	}
+
+	domain, options, hasOptions := strings.Cut(line[2:], "$")
+	if hasOptions {
+		for _, option := range strings.Split(options, ",") {
+			if !adBlockIgnoredOptions[option] {
+				return nil, false
+			}
+		}
+	}
+	domain = strings.TrimSuffix(strings.TrimSuffix(domain, "|"), "^")
+	if !validRuleDomain(domain) {
+		return nil, false
+	}
+	return []string{"=" + domain, "." + domain}, true
+}
+
+// rpzParser RPZ 区域文件的解析状态。只取 QNAME 触发器：name 精确匹配，*.name 匹配子域名；
+// rpz-ip、rpz-nsdname 等其他触发器跳过。区域名取 $ORIGIN，未声明时取 SOA 记录的所有者
+type rpzParser struct {
+	origin string
+	depth  int // 跨行记录（如 SOA）未闭合的括号数
+}
+
+func (p *rpzParser) parse(line string) ([]string, bool) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	opened := strings.Count(line, "(") - strings.Count(line, ")")
+	if p.depth > 0 {
+		p.depth += opened
+		return nil, true
+	}
+	if strings.TrimSpace(line) == "" {
+		return nil, true
+	}
+	p.depth = opened
+
+	// 行首为空白时与上一条记录同名，不重复计数
+	if line[0] == ' ' || line[0] == '\t' {
+		return nil, true
+	}
+
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(line))
+	switch strings.ToUpper(fields[0]) {
+	case "$ORIGIN":
+		if len(fields) < 2 {
+			return nil, false
+		}
+		p.origin = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		return nil, true
+	case "$TTL":
+		return nil, true
+	case "$GENERATE":
+		owners, err := expandGenerate(line)
+		if err != nil {
+			return nil, false
+		}
+		var rules []string
+		for _, owner := range owners {
+			if rule, ok := p.trigger(owner); ok && rule != "" {
+				rules = append(rules, rule)
+			}
+		}
+		return rules, len(rules) > 0
+	}
+	if fields[0][0] == '$' || len(fields) < 2 {
+		return nil, false // $INCLUDE 等不支持的指令
+	}
+
+	for _, field := range fields[1:] {
+		if strings.EqualFold(field, "SOA") {
+			if p.origin == "" && strings.HasSuffix(fields[0], ".") {
+				p.origin = strings.ToLower(strings.TrimSuffix(fields[0], "."))
+			}
+			return nil, true
+		}
+	}
+
+	rule, ok := p.trigger(fields[0])
+	if !ok {
+		return nil, false
+	}
+	if rule == "" {
+		return nil, true
+	}
+	return []string{rule}, true
+}
+
+// trigger 所有者名称转换为规则，区域顶点的记录（NS 等）返回空规则
+func (p *rpzParser) trigger(owner string) (string, bool) {
+	if owner == "@" {
+		return "", true
+	}
+	name := strings.ToLower(owner)
+	if strings.HasSuffix(name, ".") {
+		name = strings.TrimSuffix(name, ".")
+		switch {
+		case name == p.origin:
+			return "", true
+		case p.origin != "" && strings.HasSuffix(name, "."+p.origin):
+			name = strings.TrimSuffix(name, "."+p.origin)
+		case p.origin != "":
+			return "", false // 不在区域内
+		}
+	}
+
+	if last := name[strings.LastIndexByte(name, '.')+1:]; strings.HasPrefix(last, "rpz-") {
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(name, "*."); ok {
+		if !validRuleDomain(rest) {
+			return "", false
+		}
+		return "." + rest, true
+	}
+	if !validRuleDomain(name) {
+		return "", false
+	}
+	return "=" + name, true
+}
+
+// expandGenerate 展开 $GENERATE start-stop[/step] lhs ...，返回 lhs 生成的所有者名称。
+// lhs 中的 $ 替换为序号，支持 ${offset[,width[,base]]}（base 为 d、o、x、X），\$ 为字面量 $
+func expandGenerate(generate string) ([]string, error) {
+	parts := strings.Fields(generate)
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("invalid $GENERATE: %s", generate)
+	}
+
+	rangePart, stepPart, hasStep := strings.Cut(parts[1], "/")
+	startStr, stopStr, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid $GENERATE range: %s", parts[1])
+	}
+	start, err1 := strconv.Atoi(startStr)
+	stop, err2 := strconv.Atoi(stopStr)
+	step := 1
+	var err3 error
+	if hasStep {
+		step, err3 = strconv.Atoi(stepPart)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || start < 0 || stop < start || step <= 0 {
+		return nil, fmt.Errorf("invalid $GENERATE range: %s", parts[1])
+	}
+	if (stop-start)/step >= 1<<16 {
+		return nil, fmt.Errorf("$GENERATE range too large: %s", parts[1])
+	}
+
+	var result []string
+	for i := start; i <= stop; i += step {
+		name, err := generateName(parts[2], i)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// generateName 按序号替换模板中的 $ 和 ${offset,width,base}
+func generateName(template string, i int) (string, error) {
+	var name strings.Builder
+	for j := 0; j < len(template); j++ {
+		c := template[j]
+		switch {
+		case c == '\\' && j+1 < len(template) && template[j+1] == '$':
+			name.WriteByte('$')
+			j++
+		case c != '$':
+			name.WriteByte(c)
+		case j+1 < len(template) && template[j+1] == '{':
+			end := strings.IndexByte(template[j:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("invalid $GENERATE modifier in %s", template)
+			}
+			mod := strings.Split(template[j+2:j+end], ",")
+			offset, width, base := 0, 0, "d"
+			var err error
+			if offset, err = strconv.Atoi(mod[0]); err != nil {
+				return "", fmt.Errorf("invalid $GENERATE offset in %s", template)
+			}
+			if len(mod) > 1 {
+				if width, err = strconv.Atoi(mod[1]); err != nil {
+					return "", fmt.Errorf("invalid $GENERATE width in %s", template)
+				}
+			}
+			if len(mod) > 2 {
+				base = mod[2]
+			}
+			switch base {
+			case "d", "o", "x", "X":
+			default:
+				return "", fmt.Errorf("invalid $GENERATE base in %s", template)
+			}
+			fmt.Fprintf(&name, "%0*"+base, width, i+offset)
+			j += end
+		default:
+			name.WriteString(strconv.Itoa(i))
+		}
+	}
+	return name.String(), nil
+}
+
+// stripRuleComment 去掉 hosts（#）、RPZ（;）的行尾注释和 AdBlock（!）的注释行，注释中的 k=v 不作为元数据
+func stripRuleComment(line string, format string) string {
+	switch format {
+	case ruleFormatHosts:
+		line, _, _ = strings.Cut(line, "#")
+	case ruleFormatRPZ:
+		line, _, _ = strings.Cut(line, ";")
+	case ruleFormatAdBlock:
+		if strings.HasPrefix(strings.TrimSpace(line), "!") {
+			return ""
+		}
+	}
+	return line
+}
+
+// loadDomainRuleFile 读取一个域名规则文件，按格式转换后交给 add 处理，返回加载统计。
+// hosts / AdBlock / RPZ 先去掉注释，再拆下行尾已知 key 的元数据（,expires=...）后按格式解析，
+// 转换出的每条规则都带上该元数据，因此各格式都支持 expires / ttl。
+// 一行中有条目加载时计入 Accepted，否则有无效条目时计入 Skipped，其余计入 Expired
+func loadDomainRuleFile(spec string, add func(rule string, source string) ruleLoadResult) (ruleFileStat, error) {
+	format, path := splitRuleFileSpec(spec)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ruleFileStat{File: path}, err
+	}
+	if format == "" {
+		format = detectRuleFormat(content)
+	}
+	stat := ruleFileStat{File: path, Format: format}
+	parse := newRuleLineParser(format)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1<<20)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, suffix := scanner.Text(), ""
+		if format != ruleFormatList {
+			line = stripRuleComment(line, format)
+			if rule, meta, ok := cutKnownRuleMeta(line); ok {
+				line, suffix = rule, ","+meta
+			}
+		}
+		rules, ok := parse(line)
+		if !ok {
+			stat.Skipped++
+			continue
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", path, lineNum)
+		kept, invalid := false, false
+		for _, rule := range rules {
+			switch add(rule+suffix, source) {
+			case ruleKept:
+				kept = true
+			case ruleInvalid:
+				invalid = true
+			}
+		}
+		switch {
+		case kept:
+			stat.Accepted++
+		case invalid:
+			stat.Skipped++
+		default:
+			stat.Expired++
+		}
+	}
+	return stat, scanner.Err()
+}
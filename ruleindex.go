@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// ruleSetBits 规则集编号的集合，第 i 位表示编号为 i 的规则集
+type ruleSetBits uint64
+
+// maxIndexedSets 组合索引最多容纳的规则集数，超出的规则集仍逐个查找
+const maxIndexedSets = 64
+
+func (b ruleSetBits) has(bit int) bool {
+	return b&(1<<bit) != 0
+}
+
+// 组合索引按字段查找，每行日志每个字段只查找一次
+const (
+	indexFieldDomain = iota
+	indexFieldCNAME
+	indexFieldClient
+	indexFieldServer
+	indexFieldAnswer
+	indexFieldRegistrable
+	indexFieldCount
+)
+
+// indexField 表达式字段对应的索引字段，qtype / rcode 不使用规则集，返回 -1
+func indexField(field string) int {
+	switch field {
+	case matchFieldDomain:
+		return indexFieldDomain
+	case matchFieldCNAME:
+		return indexFieldCNAME
+	case matchFieldClient:
+		return indexFieldClient
+	case matchFieldServer:
+		return indexFieldServer
+	case matchFieldAnswer:
+		return indexFieldAnswer
+	case matchFieldRegistrable:
+		return indexFieldRegistrable
+	}
+	return -1
+}
+
+// ruleIndex 所有任务引用的规则集（任务清单、rule_sets、DNS服务清单、排除清单、表达式中的取值列表）的组合索引。
+// 多个任务共用同一份清单或清单大量重叠时，每行日志只需查找一次域名树和 IP 表，
+// 得到命中的规则集后由各任务的表达式按编号判断。任一任务刷新清单后整体重建
+type ruleIndex struct {
+	domains  *ValueTrieNode
+	patterns []indexedPatterns // 正则/通配符规则无法合并，按规则集逐个匹配
+	v4       []v4Segment
+	v6       *v6IndexNode
+	sets     []*ruleSnapshot // 构建时各规则集的快照，下标为规则集编号
+}
+
+type indexedPatterns struct {
+	bit      ruleSetBits
+	patterns *patternMatcher
+}
+
+// v4Segment 各规则集的 IPv4 区间切分后的不相交区段，从 start 开始到下一区段之前命中 bits
+type v4Segment struct {
+	start uint32
+	bits  ruleSetBits
+}
+
+// v6IndexNode 合并后的 IPv6 前缀树，bits 为在该前缀结束的规则集
+type v6IndexNode struct {
+	children [2]*v6IndexNode
+	bits     ruleSetBits
+}
+
+// buildRuleIndex 按规则集当前的快照构建组合索引，sets 的下标即规则集编号
+func buildRuleIndex(sets []*MatchRule) *ruleIndex {
+	idx := &ruleIndex{
+		domains: NewValueTrieNode(),
+		v6:      &v6IndexNode{},
+		sets:    make([]*ruleSnapshot, len(sets)),
+	}
+
+	type v4Event struct {
+		pos uint64
+		bit ruleSetBits
+	}
+	var events []v4Event
+
+	for i, rule := range sets {
+		set := rule.load()
+		idx.sets[i] = set
+		bit := ruleSetBits(1) << i
+		idx.domains.merge(set.domainTrie, bit)
+		if set.domainTrie.patterns != nil {
+			idx.patterns = append(idx.patterns, indexedPatterns{bit, set.domainTrie.patterns})
+		}
+
+		// 同一规则集的区间已合并，不会首尾相接，进入和离开区间都可以用异或表示
+		for _, r := range set.v4Ranges.ranges {
+			events = append(events, v4Event{uint64(r.start), bit}, v4Event{uint64(r.end) + 1, bit})
+		}
+		idx.v6.merge(set.v6Trie.root, bit)
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].pos < events[j].pos })
+	var cur ruleSetBits
+	for i := 0; i < len(events); {
+		pos := events[i].pos
+		for ; i < len(events) && events[i].pos == pos; i++ {
+			cur ^= events[i].bit
+		}
+		if pos > 0xFFFFFFFF {
+			break
+		}
+		if n := len(idx.v4); n > 0 && idx.v4[n-1].bits == cur {
+			continue
+		}
+		idx.v4 = append(idx.v4, v4Segment{uint32(pos), cur})
+	}
+	return idx
+}
+
+// merge 合入一个规则集的 IPv6 前缀树，前缀结束后的子树不影响匹配结果，无需合入
+func (n *v6IndexNode) merge(src *ipv6TrieNode, bit ruleSetBits) {
+	if src.isEnd {
+		n.bits |= bit
+		return
+	}
+	for i, child := range src.children {
+		if child == nil {
+			continue
+		}
+		if n.children[i] == nil {
+			n.children[i] = &v6IndexNode{}
+		}
+		n.children[i].merge(child, bit)
+	}
+}
+
+// domainBits 命中域名的规则集
+func (idx *ruleIndex) domainBits(domain string) ruleSetBits {
+	domain = normalizeDomain(domain)
+	bits := idx.domains.Search(domain)
+	for _, p := range idx.patterns {
+		if bits&p.bit == 0 && p.patterns.Match(domain) {
+			bits |= p.bit
+		}
+	}
+	return bits
+}
+
+// ipBits 命中地址的规则集，与 MatchRule.ipMatch 一样按地址中是否含 ':' 区分 v4/v6
+func (idx *ruleIndex) ipBits(ip string) ruleSetBits {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return 0
+	}
+
+	if strings.IndexByte(ip, ':') < 0 {
+		if !addr.Is4() {
+			return 0
+		}
+		v := v4ToUint32(addr)
+		// 找到最后一个 start <= v 的区段
+		i := sort.Search(len(idx.v4), func(i int) bool { return idx.v4[i].start > v })
+		if i == 0 {
+			return 0
+		}
+		return idx.v4[i-1].bits
+	}
+
+	b := addr.As16()
+	node := idx.v6
+	bits := node.bits
+	for i := 0; i < 128; i++ {
+		if node = node.children[b[i/8]>>(7-i%8)&1]; node == nil {
+			break
+		}
+		bits |= node.bits
+	}
+	return bits
+}
+
+// indexHit 字段中命中规则集的一项（域名或地址），按在字段中的顺序记录，供 setMatched 使用
+type indexHit struct {
+	value string
+	bits  ruleSetBits
+}
+
+// addIndexHit 记录命中的一项，返回其命中的规则集
+func (r *Record) addIndexHit(field int, value string, bits ruleSetBits) ruleSetBits {
+	if bits != 0 {
+		r.indexHits[field] = append(r.indexHits[field], indexHit{value, bits})
+	}
+	return bits
+}
+
+// lookup 查找记录某个字段命中的规则集并记录命中的各项，cname 链和响应地址取任一项命中的规则集
+func (idx *ruleIndex) lookup(rec *Record, field int) ruleSetBits {
+	var bits ruleSetBits
+	switch field {
+	case indexFieldDomain:
+		bits = rec.addIndexHit(field, rec.Domain(), idx.domainBits(rec.Domain()))
+	case indexFieldCNAME:
+		for name, rest := cutAnswer(rec.CNAME()); name != "" || rest != ""; name, rest = cutAnswer(rest) {
+			if name != "" {
+				bits |= rec.addIndexHit(field, name, idx.domainBits(name))
+			}
+		}
+	case indexFieldRegistrable:
+		if name := registrableDomain(rec.Domain()); name != "" {
+			bits = rec.addIndexHit(field, name, idx.domainBits(name))
+		}
+	case indexFieldClient:
+		bits = rec.addIndexHit(field, rec.RequestIP(), idx.ipBits(rec.RequestIP()))
+	case indexFieldServer:
+		bits = rec.addIndexHit(field, rec.DNSServer(), idx.ipBits(rec.DNSServer()))
+	case indexFieldAnswer:
+		for ip, rest := cutAnswer(rec.Result()); ip != "" || rest != ""; ip, rest = cutAnswer(rest) {
+			bits |= rec.addIndexHit(field, ip, idx.ipBits(ip))
+		}
+	}
+	return bits
+}
+
+// indexedBits 记录某个字段命中的规则集，每行第一次用到时查找组合索引
+func (r *Record) indexedBits(field int) ruleSetBits {
+	if r.indexDone&(1<<field) == 0 {
+		r.indexHits[field] = r.indexHits[field][:0]
+		r.indexBits[field] = r.index.lookup(r, field)
+		r.indexDone |= 1 << field
+	}
+	return r.indexBits[field]
+}
+
+// indexedMatch 字段中第一个命中规则集 bit 的项，需在 indexedBits 之后调用
+func (r *Record) indexedMatch(field int, bit int) (string, bool) {
+	for _, hit := range r.indexHits[field] {
+		if hit.bits.has(bit) {
+			return hit.value, true
+		}
+	}
+	return "", false
+}
+
+// collectRuleSets 收集表达式引用的规则集
+func collectRuleSets(expr matchExpr, add func(*MatchRule)) {
+	switch e := expr.(type) {
+	case *andExpr:
+		collectRuleSets(e.left, add)
+		collectRuleSets(e.right, add)
+	case *orExpr:
+		collectRuleSets(e.left, add)
+		collectRuleSets(e.right, add)
+	case *notExpr:
+		collectRuleSets(e.expr, add)
+	case *setExpr:
+		add(e.set)
+	}
+}
+
+// initRuleIndex 为所有任务引用的规则集编号并构建组合索引，汇总规则文件变化或到期时的刷新对象，需在各任务 compileMatch 之后调用
+func (T *Tasks) initRuleIndex() {
+	T.indexedSets = nil
+
+	seen := make(map[*MatchRule]bool)
+	add := func(set *MatchRule) {
+		if set == nil || seen[set] {
+			return
+		}
+		seen[set] = true
+		if len(T.indexedSets) >= maxIndexedSets {
+			set.indexBit = -1
+			return
+		}
+		set.indexBit = len(T.indexedSets)
+		T.indexedSets = append(T.indexedSets, set)
+	}
+	for _, taskName := range T.taskNames() {
+		task := T.TaskInfos[taskName]
+		collectRuleSets(task.matchExpr, add)
+		add(task.excludeRule)
+		task.refreshHook = T.refreshRules
+	}
+	T.ruleTargets = T.ruleWatchTargets()
+	if len(seen) > maxIndexedSets {
+		fmt.Printf("%d rule sets in use, only the first %d are indexed\n", len(seen), maxIndexedSets)
+	}
+
+	T.ruleIndex.Store(buildRuleIndex(T.indexedSets))
+	T.scheduleRuleExpiry()
+}
+
+// refreshRules 任务刷新清单时调用：重新加载后重建组合索引并原子替换，分析线程在下一个文件使用新索引。
+// indexLock 保证多个任务同时刷新时依次加载和重建，后发布的索引包含全部最新快照
+func (T *Tasks) refreshRules(reload func()) {
+	T.indexLock.Lock()
+	defer T.indexLock.Unlock()
+
+	reload()
+	T.ruleIndex.Store(buildRuleIndex(T.indexedSets))
+	T.scheduleRuleExpiry()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ruleMeta 规则文件中附加在规则之后的元数据，如 evil.com,category=c2,source=feedX,id=123,expires=2026-11-01
+type ruleMeta struct {
+	category string
+	source   string
+	id       string
+	expires  time.Time     // 到期时间，见 expiresAt
+	ttl      time.Duration // 有效期，从规则文件的修改时间起算
+	invalid  bool          // expires 或 ttl 无法解析，条目不加载
+}
+
+// splitRuleMeta 拆分规则和元数据，见 cutRuleMeta。未知的 key 会打印后忽略
+func splitRuleMeta(line string, source string) (string, *ruleMeta) {
+	if rule, meta, ok := cutRuleMeta(line); ok {
+		return rule, parseRuleMeta(meta, source)
+	}
+	return line, nil
+}
+
+// 支持的元数据 key
+var ruleMetaKeys = map[string]bool{
+	"category": true,
+	"source":   true,
+	"id":       true,
+	"expires":  true,
+	"ttl":      true,
+}
+
+// cutRuleMeta 从左向右找到第一个逗号，其后全部为 key=value 时才视为元数据，
+// 因此正则中的逗号（如 {30,}）不受影响
+func cutRuleMeta(line string) (rule string, meta string, ok bool) {
+	return cutRuleMetaKeys(line, nil)
+}
+
+// cutKnownRuleMeta 同 cutRuleMeta，但 key 必须在 ruleMetaKeys 中，
+// 用于 hosts / AdBlock / RPZ，避免 AdBlock 的 $important,domain=a.com 等选项被当作元数据
+func cutKnownRuleMeta(line string) (rule string, meta string, ok bool) {
+	return cutRuleMetaKeys(line, ruleMetaKeys)
+}
+
+// cutRuleMetaKeys keys 为 nil 时接受任意小写 key
+func cutRuleMetaKeys(line string, keys map[string]bool) (rule string, meta string, ok bool) {
+	for i := strings.IndexByte(line, ','); i >= 0; {
+		if isRuleMeta(line[i+1:], keys) {
+			return strings.TrimSpace(line[:i]), line[i+1:], true
+		}
+		next := strings.IndexByte(line[i+1:], ',')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return line, "", false
+}
+
+// isRuleMeta 是否为 key=value[,key=value] 格式，key 只包含小写字母和下划线，keys 不为 nil 时还需在其中
+func isRuleMeta(s string, keys map[string]bool) bool {
+	for _, pair := range strings.Split(s, ",") {
+		key, _, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" || strings.TrimLeft(key, "abcdefghijklmnopqrstuvwxyz_") != "" {
+			return false
+		}
+		if keys != nil && !keys[key] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseRuleMeta(s string, source string) *ruleMeta {
+	meta := &ruleMeta{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		switch key {
+		case "category":
+			meta.category = value
+		case "source":
+			meta.source = value
+		case "id":
+			meta.id = value
+		case "expires":
+			expires, err := parseRuleExpires(value)
+			if err != nil {
+				fmt.Printf("Invalid rule expires %q at %s, entry skipped\n", value, source)
+				meta.invalid = true
+				continue
+			}
+			meta.expires = expires
+		case "ttl":
+			ttl, err := parseRuleTTL(value)
+			if err != nil {
+				fmt.Printf("Invalid rule ttl %q at %s, entry skipped\n", value, source)
+				meta.invalid = true
+				continue
+			}
+			meta.ttl = ttl
+		default:
+			fmt.Printf("Unknown rule metadata %q at %s\n", key, source)
+		}
+	}
+	return meta
+}
+
+// 记录命中的规则，输出 matched_name 和 rule_* 字段时使用
+type matchedRule struct {
+	set   *ruleSnapshot // 命中时使用的规则集快照
+	value string        // 命中的域名或 IP
+	isIP  bool
+}
+
+// setMatched 记录第一个命中的规则，始终返回 true，便于在匹配条件中使用
+func (r *Record) setMatched(set *ruleSnapshot, value string, isIP bool) bool {
+	if r.matched.set == nil {
+		r.matched = matchedRule{set: set, value: value, isIP: isIP}
+	}
+	return true
+}
+
+// matchedName 命中的域名（请求域名或 cname 链中的某一项）
+func (r *Record) matchedName() string {
+	if r.matched.isIP {
+		return ""
+	}
+	return r.matched.value
+}
+
+// matchedMeta 命中规则的元数据，只在输出时查找，域名取最具体的规则，IP 取最长前缀
+func (r *Record) matchedMeta() *ruleMeta {
+	if r.matched.set == nil {
+		return nil
+	}
+	if r.matched.isIP {
+		return r.matched.set.ipMeta(r.matched.value)
+	}
+	return r.matched.set.domainTrie.lookupMeta(r.matched.value)
+}
+
+// writeRuleMeta 输出命中规则的元数据字段
+func writeRuleMeta(buf *bytes.Buffer, rec *Record, field int) {
+	meta := rec.matchedMeta()
+	if meta == nil {
+		return
+	}
+	switch field {
+	case outputRuleCategory:
+		buf.WriteString(meta.category)
+	case outputRuleSource:
+		buf.WriteString(meta.source)
+	case outputRuleID:
+		buf.WriteString(meta.id)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP(S) 规则源的默认设置
+const (
+	defaultRuleSourceInterval = 10 * time.Minute
+	defaultRuleSourceTimeout  = 30 * time.Second
+	defaultRuleSourceMaxSize  = 100 << 20
+	defaultRuleSourceCacheDir = "rule_cache"
+)
+
+// ruleSource 通过 HTTP(S) 获取的规则文件。内容保存在本地缓存文件中，规则始终从缓存文件加载，
+// 获取失败时继续使用上次成功获取的内容
+type ruleSource struct {
+	url       string
+	cacheFile string
+
+	lock   sync.Mutex
+	status ruleSourceStatus
+}
+
+// ruleSourceStatus 规则源的获取状态。ETag / Last-Modified 同时保存在缓存文件旁的 .meta 中，重启后仍使用条件请求
+type ruleSourceStatus struct {
+	URL          string    `json:"url"`
+	CacheFile    string    `json:"cache_file"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`
+	LastAttempt  time.Time `json:"last_attempt"`
+	LastSuccess  time.Time `json:"last_success"` // 最近一次获取成功（内容更新或未修改）
+	LastUpdate   time.Time `json:"last_update"`  // 最近一次内容更新
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// isRuleSourceURL 规则文件是否为 HTTP(S) 地址
+func isRuleSourceURL(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// ruleSourceCacheFile 缓存文件名：地址的摘要加上地址中的文件名，便于辨认
+func ruleSourceCacheFile(dir string, rawURL string) string {
+	name := "index"
+	if u, err := url.Parse(rawURL); err == nil {
+		if base := path.Base(u.Path); base != "." && base != "/" {
+			name = base
+		}
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(dir, fmt.Sprintf("%x-%s", sum[:6], name))
+}
+
+// newRuleSource 创建规则源，读取上次保存的缓存信息
+func newRuleSource(rawURL string, cacheDir string) *ruleSource {
+	src := &ruleSource{url: rawURL, cacheFile: ruleSourceCacheFile(cacheDir, rawURL)}
+	src.status = ruleSourceStatus{URL: rawURL, CacheFile: src.cacheFile}
+	if content, err := os.ReadFile(src.cacheFile + ".meta"); err == nil {
+		json.Unmarshal(content, &src.status)
+	}
+	if info, err := os.Stat(src.cacheFile); err == nil {
+		src.status.Size = info.Size()
+	} else {
+		// 缓存文件不存在时不能使用条件请求
+		src.status.ETag, src.status.LastModified = "", ""
+	}
+	return src
+}
+
+// getStatus 获取当前状态
+func (s *ruleSource) getStatus() ruleSourceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status
+}
+
+// fetch 使用条件请求获取规则，内容有更新时先写临时文件再改名替换缓存，返回缓存是否更新
+func (s *ruleSource) fetch(client *http.Client, maxSize int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.status.LastAttempt = time.Now()
+	updated, err := s.download(client, maxSize)
+	if err != nil {
+		s.status.LastError = err.Error()
+		return false, err
+	}
+	s.status.LastError = ""
+	s.status.LastSuccess = s.status.LastAttempt
+	if updated {
+		s.status.LastUpdate = s.status.LastAttempt
+	}
+	if content, err := json.Marshal(&s.status); err == nil {
+		os.WriteFile(s.cacheFile+".meta", content, 0644)
+	}
+	return updated, nil
+}
+
+func (s *ruleSource) download(client *http.Client, maxSize int64) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if s.status.ETag != "" {
+		req.Header.Set("If-None-Match", s.status.ETag)
+	}
+	if s.status.LastModified != "" {
+		req.Header.Set("If-Modified-Since", s.status.LastModified)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return false, fmt.Errorf("size %d exceeds limit %d", resp.ContentLength, maxSize)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.cacheFile), 0755); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.cacheFile), filepath.Base(s.cacheFile)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	// 多读一个字节判断是否超出限制，未声明长度的响应也不会写满磁盘
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, maxSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if n > maxSize {
+		return false, fmt.Errorf("size exceeds limit %d", maxSize)
+	}
+	if err := os.Rename(tmp.Name(), s.cacheFile); err != nil {
+		return false, err
+	}
+
+	s.status.ETag = resp.Header.Get("ETag")
+	s.status.LastModified = resp.Header.Get("Last-Modified")
+	s.status.Size = n
+	return true, nil
+}
+
+// resolveRuleSources 将配置中的 HTTP(S) 规则地址替换为本地缓存文件，格式前缀保留，如 hosts:https://... 。
+// 同一地址只获取一次，多处引用共用一个缓存文件
+func (T *Tasks) resolveRuleSources() {
+	cacheDir := T.RuleSourceCacheDir
+	if cacheDir == "" {
+		cacheDir = defaultRuleSourceCacheDir
+	}
+	if T.ruleSources == nil {
+		T.ruleSources = make(map[string]*ruleSource)
+	}
+	resolve := func(specs []string) {
+		for i, spec := range specs {
+			format, file := splitRuleFileSpec(spec)
+			if !isRuleSourceURL(file) {
+				continue
+			}
+			src, ok := T.ruleSources[file]
+			if !ok {
+				src = newRuleSource(file, cacheDir)
+				T.ruleSources[file] = src
+				markManagedRuleFile(src.cacheFile)
+			}
+			if format != "" {
+				specs[i] = format + ":" + src.cacheFile
+			} else {
+				specs[i] = src.cacheFile
+			}
+		}
+	}
+
+	resolve(T.ExcludeIpRuler)
+	resolve(T.ExcludeDomainRuler)
+	for _, task := range T.TaskInfos {
+		resolve(task.FilterIpRuler)
+		resolve(task.FilterDomainRuler)
+		resolve(task.FilterDNSServerRuler)
+		resolve(task.ExcludeIpRuler)
+		resolve(task.ExcludeDomainRuler)
+	}
+	for _, info := range T.RuleSets {
+		resolve(info.IpRuler)
+		resolve(info.DomainRuler)
+	}
+}
+
+// initRuleSources 替换规则地址后获取一次全部规则源，获取失败时使用上次的缓存
+func (T *Tasks) initRuleSources() {
+	T.resolveRuleSources()
+	if len(T.ruleSources) == 0 {
+		return
+	}
+
+	timeout := T.RuleSourceTimeout
+	if timeout <= 0 {
+		timeout = defaultRuleSourceTimeout
+	}
+	T.ruleSourceClient = &http.Client{Timeout: timeout}
+	if T.ruleSourceMaxSize = int64(parseSize(T.RuleSourceMaxSizeString)); T.ruleSourceMaxSize <= 0 {
+		T.ruleSourceMaxSize = defaultRuleSourceMaxSize
+	}
+
+	for _, src := range T.ruleSources {
+		if _, err := src.fetch(T.ruleSourceClient, T.ruleSourceMaxSize); err != nil {
+			if fileExists(src.cacheFile) {
+				log.Printf("[rule source] fetch %s failed, using cached %s: %v\n", src.url, src.cacheFile, err)
+			} else {
+				log.Printf("[rule source] fetch %s failed and no cached copy: %v\n", src.url, err)
+			}
+			continue
+		}
+		fmt.Printf("Fetched rule source %s (%d bytes) to %s\n", src.url, src.getStatus().Size, src.cacheFile)
+	}
+}
+
+// fetchRuleSources 按 rule_source_interval 定期获取规则源，内容更新后刷新引用该缓存文件的任务或规则集
+func (T *Tasks) fetchRuleSources() {
+	if len(T.ruleSources) == 0 {
+		return
+	}
+	interval := T.RuleSourceInterval
+	if interval <= 0 {
+		interval = defaultRuleSourceInterval
+	}
+
+	for range time.Tick(interval) {
+		for _, src := range T.ruleSources {
+			updated, err := src.fetch(T.ruleSourceClient, T.ruleSourceMaxSize)
+			if err != nil {
+				log.Printf("[rule source] fetch %s failed, keep current rules: %v\n", src.url, err)
+				continue
+			}
+			if updated {
+				log.Printf("[rule source] %s updated (%d bytes)\n", src.url, src.getStatus().Size)
+				T.ruleFileChanged(src.cacheFile)
+			}
+		}
+	}
+}
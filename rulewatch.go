@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// 规则文件变化后的默认等待时间，期间的多次变化合并为一次刷新
+const defaultRuleWatchDebounce = time.Second
+
+// ruleWatchTarget 规则文件变化或条目到期后需要刷新的对象：一个任务的全部清单，或一个命名规则集
+type ruleWatchTarget struct {
+	name     string
+	rules    []*MatchRule
+	files    []string
+	counts   func() ruleCounts
+	refresh  func()
+	expiring atomic.Bool // 正在因条目到期重新加载
+
+	// 文件监听和规则源获取都会调用 schedule
+	timerLock sync.Mutex
+	timer     *time.Timer
+	changed   map[string]bool // 等待期间变化的文件
+}
+
+// schedule 等待 debounce 后刷新，等待期间再次变化时重新计时
+func (t *ruleWatchTarget) schedule(debounce time.Duration, file string) {
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+	if t.changed == nil {
+		t.changed = make(map[string]bool)
+	}
+	t.changed[file] = true
+	if t.timer == nil {
+		t.timer = time.AfterFunc(debounce, t.fire)
+		return
+	}
+	t.timer.Reset(debounce)
+}
+
+// fire 刷新并输出刷新前后的规则数。编辑器先删除或改名再写入新文件时，
+// 变化的文件暂时不存在，此时保留当前规则，等文件重新创建后再刷新；
+// 只检查本次变化的文件，其他一直不存在的清单不影响刷新
+func (t *ruleWatchTarget) fire() {
+	t.timerLock.Lock()
+	changed := t.changed
+	t.changed = nil
+	t.timerLock.Unlock()
+
+	for file := range changed {
+		if _, err := os.Stat(file); err != nil {
+			log.Printf("[rule watch] %s: %s is not available, keep current rules until it is recreated: %v\n", t.name, file, err)
+			return
+		}
+	}
+
+	before := t.counts()
+	t.refresh()
+	after := t.counts()
+	log.Printf("[rule watch] %s refreshed: v4 %d -> %d, v6 %d -> %d, domain %d -> %d\n",
+		t.name, before.v4, after.v4, before.v6, after.v6, before.domain, after.domain)
+}
+
+// ruleWatchTargets 每个任务和命名规则集各一个刷新对象，全局排除清单已合并到各任务中
+func (T *Tasks) ruleWatchTargets() []*ruleWatchTarget {
+	var targets []*ruleWatchTarget
+	add := func(target *ruleWatchTarget, rules ...*MatchRule) {
+		for _, r := range rules {
+			if r != nil {
+				target.rules = append(target.rules, r)
+				target.files = append(target.files, r.files()...)
+			}
+		}
+		targets = append(targets, target)
+	}
+
+	for _, taskName := range T.taskNames() {
+		task := T.TaskInfos[taskName]
+		add(&ruleWatchTarget{
+			name: "task " + taskName,
+			counts: func() ruleCounts {
+				return task.taskMatchRule.GetCounts().add(task.dnsServerRule.GetCounts()).add(task.excludeRule.GetCounts())
+			},
+			refresh: task.RefreshIPList,
+		}, task.taskMatchRule, task.dnsServerRule, task.excludeRule)
+	}
+	for name, set := range T.ruleSets {
+		add(&ruleWatchTarget{
+			name:    "rule set " + name,
+			counts:  set.GetCounts,
+			refresh: func() { T.refreshRuleSet(set) },
+		}, set)
+	}
+	return targets
+}
+
+// refreshRuleSet 刷新命名规则集并重建组合索引，引用它的各任务在下一个文件使用新规则
+func (T *Tasks) refreshRuleSet(set *MatchRule) {
+	T.refreshRules(set.reload)
+}
+
+// ruleWatchDebounce 规则文件变化后的等待时间
+func (T *Tasks) ruleWatchDebounce() time.Duration {
+	if T.RuleWatchDebounce <= 0 {
+		return defaultRuleWatchDebounce
+	}
+	return T.RuleWatchDebounce
+}
+
+// ruleFileChanged 规则文件已更新（如规则源写入了新的缓存），刷新引用它的任务或规则集
+func (T *Tasks) ruleFileChanged(file string) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return
+	}
+	for _, target := range T.ruleTargets {
+		for _, f := range target.files {
+			if p, err := filepath.Abs(f); err == nil && p == abs {
+				target.schedule(T.ruleWatchDebounce(), abs)
+				break
+			}
+		}
+	}
+}
+
+// watchRuleFiles 监听全部 IP 和域名规则文件，变化后只刷新引用该文件的任务或规则集。
+// 监听的是文件所在目录，编辑器保存时先写临时文件再改名覆盖也能收到事件；
+// 无法监听的目录打印后跳过，其中的文件不会自动刷新。返回停止监听的函数
+func (T *Tasks) watchRuleFiles() (func(), error) {
+	// 按文件（绝对路径）汇总需要刷新的对象
+	byFile := make(map[string][]*ruleWatchTarget)
+	for _, target := range T.ruleTargets {
+		for _, file := range target.files {
+			if abs, err := filepath.Abs(file); err == nil {
+				byFile[abs] = append(byFile[abs], target)
+			}
+		}
+	}
+	if len(byFile) == 0 {
+		return func() {}, nil
+	}
+
+	debounce := T.ruleWatchDebounce()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]bool)
+	for file := range byFile {
+		dirs[filepath.Dir(file)] = true
+	}
+	watched := 0
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Printf("[rule watch] cannot watch %s, changes in it are not picked up: %v\n", dir, err)
+			continue
+		}
+		watched++
+	}
+	log.Printf("[rule watch] watching %d rule files in %d of %d directories\n", len(byFile), watched, len(dirs))
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+					continue
+				}
+				file := filepath.Clean(event.Name)
+				for _, target := range byFile[file] {
+					target.schedule(debounce, file)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[rule watch] error: %v\n", err)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		watcher.Close()
+	}, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"time"
 )
 
@@ -13,14 +14,16 @@ func Run() {
 	}
 
 	for _, task := range tasks.TaskInfos {
-		if task.ForceDomainMode {
-			//检查规则文件的时间
+		if len(task.SQLSources) > 0 {
+			//定期同步数据库规则源
 			go func() {
 
-				for range time.Tick(task.ForceDomainUpdate) {
+				for range time.Tick(task.SQLUpdate) {
 
-					task.queryAndWriteDomains(task.ForceDomainList)
-					task.RefreshIPList()
+					//清单有更新时才重新加载
+					if task.syncSQLSources() {
+						task.RefreshIPList()
+					}
 
 					//printDetailedStats()
 				}
@@ -29,6 +32,14 @@ func Run() {
 		}
 	}
 
+	//定期获取 HTTP(S) 规则源
+	go tasks.fetchRuleSources()
+
+	//规则文件变化后自动刷新引用它的任务
+	if _, err := tasks.watchRuleFiles(); err != nil {
+		log.Printf("规则文件监听失败，仅按 sql_update 定期刷新数据库规则源的清单: %v\n", err)
+	}
+
 	fmt.Printf(
 		"================运行信息============================\n"+
 			"网卡名称：%s\n"+
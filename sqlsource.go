@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// 数据库规则源的类型
+const (
+	sqlSourceDomain = "domain"
+	sqlSourceIP     = "ip"
+)
+
+// 数据库规则源的默认同步间隔、查询超时和允许的清单缩减比例（百分比）
+const (
+	defaultSQLUpdate    = time.Minute
+	defaultSQLTimeout   = 30 * time.Second
+	defaultSQLMaxShrink = 50
+)
+
+// sqlMetaColumns 可以写为规则元数据的列名
+var sqlMetaColumns = map[string]bool{"category": true, "source": true, "id": true, "expires": true, "ttl": true}
+
+// sqlDriverName 配置中的数据库类型对应的 database/sql 驱动名
+func sqlDriverName(driver string) (string, error) {
+	switch strings.ToLower(driver) {
+	case "", "mysql":
+		return "mysql", nil
+	case "postgres", "postgresql", "pg":
+		return "postgres", nil
+	case "sqlite", "sqlite3":
+		return "sqlite", nil
+	}
+	return "", fmt.Errorf("unsupported sql driver %q, expected mysql, postgres or sqlite", driver)
+}
+
+// name 日志中使用的名称
+func (s *SQLSourceInfo) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Driver + " " + s.Type
+}
+
+// dsn 替换密码后的连接串
+func (s *SQLSourceInfo) dsn() string {
+	password := ""
+	if s.Password != "" {
+		password = decString(s.Password)
+	}
+	return strings.ReplaceAll(s.DSN, "{password}", password)
+}
+
+// validate 校验并补全默认值，只允许 select 查询
+func (s *SQLSourceInfo) validate() error {
+	driver, err := sqlDriverName(s.Driver)
+	if err != nil {
+		return err
+	}
+	s.Driver = driver
+	if s.Type == "" {
+		s.Type = sqlSourceDomain
+	}
+	if s.Type != sqlSourceDomain && s.Type != sqlSourceIP {
+		return fmt.Errorf("sql source %s: invalid type %q, expected domain or ip", s.name(), s.Type)
+	}
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(s.Query)), "select") {
+		return fmt.Errorf("sql source %s: only support select operation", s.name())
+	}
+	return nil
+}
+
+// formatSQLValue 数据库中的值转为元数据的取值，逗号会被当作元数据的分隔符，替换为空格
+func formatSQLValue(value any) string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		s = v.Format(time.RFC3339)
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	default:
+		s = fmt.Sprint(v)
+	}
+	return strings.ReplaceAll(strings.TrimSpace(s), ",", " ")
+}
+
+// open 打开连接池，各次同步复用，连接空闲或使用一段时间后自动关闭重连
+func (s *SQLSourceInfo) open() (*sql.DB, error) {
+	if s.db != nil {
+		return s.db, nil
+	}
+	db, err := sql.Open(s.Driver, s.dsn())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxIdleTime(10 * time.Minute)
+	db.SetConnMaxLifetime(time.Hour)
+	s.db = db
+	return db, nil
+}
+
+// query 执行查询，返回规则行：规则,key=value...。timeout 包括读取全部结果的时间
+func (s *SQLSourceInfo) query(timeout time.Duration) ([]string, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, s.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range columns[1:] {
+		if !sqlMetaColumns[strings.ToLower(column)] {
+			fmt.Printf("sql source %s: column %q is not rule metadata, ignored\n", s.name(), column)
+		}
+	}
+
+	var lines []string
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		// 跳过读取失败的行会得到不完整的结果
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		rule := formatSQLValue(values[0])
+		if rule == "" {
+			continue
+		}
+		var line strings.Builder
+		line.WriteString(rule)
+		for i, column := range columns[1:] {
+			key := strings.ToLower(column)
+			if value := formatSQLValue(values[i+1]); value != "" && sqlMetaColumns[key] {
+				line.WriteString("," + key + "=" + value)
+			}
+		}
+		lines = append(lines, line.String())
+	}
+	// 超时或连接中断时结果不完整，不能用于替换清单
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// initSQLSources 转换 force_domain_mode 的配置，校验数据库规则源，将合并后的清单加入过滤清单并同步一次
+func (t *TaskInfo) initSQLSources(taskName string) error {
+	if t.ForceDomainMode {
+		t.SQLSources = append(t.SQLSources, &SQLSourceInfo{
+			Name:     "force_domain",
+			Driver:   "mysql",
+			DSN:      fmt.Sprintf("%s:{password}@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True", t.UmpMysqlUser, t.UmpMysqlHost, t.UmpMysqlPort, t.DbName),
+			Password: t.UmpMysqlPass,
+			Query:    t.ForceDomainSql,
+			Type:     sqlSourceDomain,
+		})
+		if t.SQLDomainList == "" {
+			t.SQLDomainList = t.ForceDomainList
+		}
+		if t.SQLUpdate <= 0 {
+			t.SQLUpdate = t.ForceDomainUpdate
+		}
+	}
+	if len(t.SQLSources) == 0 {
+		return nil
+	}
+	if t.SQLUpdate <= 0 {
+		t.SQLUpdate = defaultSQLUpdate
+	}
+	if t.SQLTimeout <= 0 {
+		t.SQLTimeout = defaultSQLTimeout
+	}
+	t.sqlMaxShrink = defaultSQLMaxShrink
+	if t.SQLMaxShrink != nil {
+		if *t.SQLMaxShrink < 0 || *t.SQLMaxShrink > 100 {
+			return fmt.Errorf("invalid sql_max_shrink %d, expected 0-100", *t.SQLMaxShrink)
+		}
+		t.sqlMaxShrink = *t.SQLMaxShrink
+	}
+
+	addList := func(rulers []string, file string) []string {
+		for _, ruler := range rulers {
+			if ruler == file {
+				return rulers
+			}
+		}
+		return append(rulers, file)
+	}
+	for _, src := range t.SQLSources {
+		if err := src.validate(); err != nil {
+			return err
+		}
+		if src.Type == sqlSourceDomain {
+			if t.SQLDomainList == "" {
+				t.SQLDomainList = fmt.Sprintf("sql_%s_domain.list", taskName)
+			}
+			t.FilterDomainRuler = addList(t.FilterDomainRuler, t.SQLDomainList)
+			markManagedRuleFile(t.SQLDomainList)
+		} else {
+			if t.SQLIPList == "" {
+				t.SQLIPList = fmt.Sprintf("sql_%s_ip.list", taskName)
+			}
+			t.FilterIpRuler = addList(t.FilterIpRuler, t.SQLIPList)
+			markManagedRuleFile(t.SQLIPList)
+		}
+	}
+
+	t.syncSQLSources()
+
+	// 启动时数据库不可用也创建空清单，否则规则文件监听会因清单不存在而一直不刷新该任务的其他清单
+	for _, filename := range []string{t.SQLDomainList, t.SQLIPList} {
+		if filename == "" || fileExists(filename) {
+			continue
+		}
+		if err := writeListFile(filename, nil); err != nil {
+			return fmt.Errorf("create sql rule list %s: %v", filename, err)
+		}
+		log.Printf("[sql source] %s 尚未同步成功，已创建空清单\n", filename)
+	}
+	return nil
+}
+
+// syncSQLSources 查询全部数据库规则源，同类型的结果合并去重（保留第一条的元数据）后写入清单文件，返回是否有清单更新。
+// 任一规则源查询失败、结果为空（未开启 sql_allow_empty）或比当前清单减少超过 sql_max_shrink 时保留当前清单
+func (t *TaskInfo) syncSQLSources() bool {
+	syncList := func(ruleType string, filename string) bool {
+		if filename == "" {
+			return false
+		}
+		start := time.Now()
+		seen := make(map[string]bool)
+		var lines []string
+		sources := 0
+		for _, src := range t.SQLSources {
+			if src.Type != ruleType {
+				continue
+			}
+			found, err := src.query(t.SQLTimeout)
+			if err != nil {
+				log.Printf("[sql source] %s 查询失败，保留当前清单 %s: %v\n", src.name(), filename, err)
+				return false
+			}
+			for _, line := range found {
+				rule, _, _ := strings.Cut(line, ",")
+				if !seen[rule] {
+					seen[rule] = true
+					lines = append(lines, line)
+				}
+			}
+			sources++
+		}
+		if sources == 0 {
+			return false
+		}
+
+		// 数据库返回空结果或大量减少时多半是数据异常，替换后会使过滤失效
+		if len(lines) == 0 && !t.SQLAllowEmpty {
+			log.Printf("[sql source] %s 的%s规则查询结果为空，未开启 sql_allow_empty，保留当前清单\n", filename, ruleType)
+			return false
+		}
+		if current := countListLines(filename); current > 0 && t.sqlMaxShrink < 100 {
+			if shrink := (current - len(lines)) * 100 / current; shrink > t.sqlMaxShrink {
+				log.Printf("[sql source] %s 的%s规则从 %d 条减少到 %d 条（%d%%），超过 sql_max_shrink %d%%，保留当前清单\n",
+					filename, ruleType, current, len(lines), shrink, t.sqlMaxShrink)
+				return false
+			}
+		}
+
+		if err := writeListFile(filename, lines); err != nil {
+			log.Printf("[sql source] 写入 %s 失败，保留当前清单: %v\n", filename, err)
+			return false
+		}
+		log.Printf("[sql source] 读取 %d 个规则源完成(%v)，%d 条%s规则已写入 %s\n", sources, time.Since(start), len(lines), ruleType, filename)
+		return true
+	}
+
+	domainUpdated := syncList(sqlSourceDomain, t.SQLDomainList)
+	ipUpdated := syncList(sqlSourceIP, t.SQLIPList)
+	return domainUpdated || ipUpdated
+}
+
+// countListLines 清单文件中的非空行数，文件不存在时为 0
+func countListLines(filename string) int {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// writeListFile 先写入同目录的临时文件，完成后改名替换清单，读取方不会读到写了一半的清单
+func writeListFile(filename string, lines []string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriterSize(tmp, 64*1024)
+	for _, line := range lines {
+		writer.WriteString(line)
+		writer.WriteByte('\n')
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// CreateTemp 创建的文件权限为 0600，改为清单文件通常的 0644
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -10,8 +10,35 @@ import (
 func (T *Tasks) getStatus(c *gin.Context) {
 
 	T.statusLock.Lock()
-	jsonData, err := json.Marshal(T.RunStatus)
-	fmt.Println(T.RunStatus)
+	T.TaskFilterModes = make(map[string]taskFilterMode, len(T.TaskInfos))
+	T.RuleFileStats = make(map[string]ruleFileStat)
+	addFileStats := func(r *MatchRule) {
+		if r == nil {
+			return
+		}
+		for _, stat := range r.GetDomainFileStats() {
+			T.RuleFileStats[stat.File] = stat
+		}
+	}
+	for _, set := range T.ruleSets {
+		addFileStats(set)
+	}
+	T.RuleSourceStats = make(map[string]ruleSourceStatus, len(T.ruleSources))
+	for url, src := range T.ruleSources {
+		T.RuleSourceStats[url] = src.getStatus()
+	}
+	for taskName, task := range T.TaskInfos {
+		if task.taskMatchRule == nil {
+			continue
+		}
+		addFileStats(task.taskMatchRule)
+		addFileStats(task.excludeRule)
+		T.TaskFilterModes[taskName] = taskFilterMode{
+			Match:  task.matchSource,
+			IPMode: ipModeName(task.taskMatchRule.GetFilterMode()),
+		}
+	}
+	jsonData, err := json.Marshal(&T.RunStatus)
 	fmt.Println(string(jsonData))
 	if err != nil {
 		c.String(http.StatusServiceUnavailable, err.Error())
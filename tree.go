@@ -1,15 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 	"strings"
 )
 
+// 域名规则的匹配方式，可以组合
 const (
-	Exact    byte = 1
-	Multiple byte = 2
+	Exact    byte = 1 // 仅匹配域名本身
+	Multiple byte = 2 // 仅匹配子域名
 	notMatch byte = 0
 )
 
@@ -18,6 +17,33 @@ type TrieNode struct {
 	children  map[string]*TrieNode
 	isEnd     bool // isEnd marks the end of a domain
 	matchType byte
+
+	// 规则元数据，分别对应精确匹配和子域名匹配
+	exactMeta    *ruleMeta
+	multipleMeta *ruleMeta
+
+	// 仅根节点使用：正则/通配符规则
+	patterns *patternMatcher
+}
+
+// parseDomainRule 解析单行域名规则，返回域名和匹配方式：
+//
+//	=a.com          仅匹配 a.com
+//	.a.com / *.a.com 仅匹配 a.com 的子域名
+//	a.com           匹配 a.com 及其子域名；exactDefault 为 true（domain_exact_match）时仅匹配 a.com
+func parseDomainRule(rule string, exactDefault bool) (string, byte) {
+	switch {
+	case strings.HasPrefix(rule, "="):
+		return rule[1:], Exact
+	case strings.HasPrefix(rule, "*."):
+		return rule[2:], Multiple
+	case strings.HasPrefix(rule, "."):
+		return rule[1:], Multiple
+	case exactDefault:
+		return rule, Exact
+	default:
+		return rule, Exact | Multiple
+	}
 }
 
 // NewTrieNode creates a new Trie node
@@ -26,21 +52,20 @@ func NewTrieNode() *TrieNode {
 }
 
 // Insert inserts a domain into the v6Trie
-// Insert inserts a domain into the v6Trie
+// 规则语法见 parseDomainRule，不带前缀的域名同时匹配自身及子域名
 func (t *TrieNode) Insert(domain string) {
-	parts := splitDomain(domain)
-	node := t
-	for _, part := range parts {
-		if _, ok := node.children[part]; !ok {
-			node.children[part] = NewTrieNode()
-		}
-		node = node.children[part]
-	}
-	node.isEnd = true
+	t.InsertRule(domain, false)
 }
 
-func (t *TrieNode) v6Insert(domain string) {
-	parts := strings.Split(domain, ":")
+// InsertRule 按规则语法插入域名，exactDefault 决定不带前缀的域名是否仅精确匹配
+func (t *TrieNode) InsertRule(rule string, exactDefault bool) {
+	t.InsertRuleMeta(rule, exactDefault, nil)
+}
+
+// InsertRuleMeta 插入域名及其元数据，同一域名同一匹配方式的多条规则保留第一条的元数据
+func (t *TrieNode) InsertRuleMeta(rule string, exactDefault bool, meta *ruleMeta) {
+	domain, matchType := parseDomainRule(rule, exactDefault)
+	parts := splitDomain(normalizeDomain(domain))
 	node := t
 	for _, part := range parts {
 		if _, ok := node.children[part]; !ok {
@@ -49,6 +74,15 @@ func (t *TrieNode) v6Insert(domain string) {
 		node = node.children[part]
 	}
 	node.isEnd = true
+	node.matchType |= matchType
+	if meta != nil {
+		if matchType&Exact != 0 && node.exactMeta == nil {
+			node.exactMeta = meta
+		}
+		if matchType&Multiple != 0 && node.multipleMeta == nil {
+			node.multipleMeta = meta
+		}
+	}
 }
 
 func (t *TrieNode) print() {
@@ -63,74 +97,79 @@ func printNode(node *TrieNode) {
 }
 
 // Search searches for a domain in the v6Trie
+// 先查找普通域名规则，未命中时再匹配正则/通配符规则，查找前按 normalizeDomain 规范化
 func (t *TrieNode) Search(domain string) bool {
-	//todo: search时，node.isEND代表的是上一级的结果，当前层级的isEND应该在下一级展示,暂未研究是否可以优化insert
+	domain = normalizeDomain(domain)
+	if t.searchLabels(domain) {
+		return true
+	}
+	return t.patterns != nil && t.patterns.Match(domain)
+}
 
-	parts := splitDomain(domain)
-	node := t
+// searchLabels 从右向左逐个 label 查找，不切分、不分配内存。
+// 经过的节点带有子域名匹配且还有剩余 label 时命中，走到最后一个 label 时按精确匹配判断。
+func (t *TrieNode) searchLabels(domain string) bool {
 
-	for i, part := range parts {
+	node := t
 
-		//fmt.Printf("i:%d, Search for: %s, isEnd: %v, MatchType: %v\n", i, part, node.isEnd, node.matchType)
-		//if _, ok := node.children[part]; ok {
-		//	fmt.Println(node.children[part].children)
-		//}
+	for end := len(domain); end >= 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		part := domain[start:end]
 
-		if _, ok := node.children[part]; !ok {
+		child, ok := node.children[part]
+		if !ok {
 			return false
 		}
 
-		//如果下一级存在*的匹配，立即返回true
-		if _, ok := node.children[part].children["*"]; ok {
-			return true
+		if start == 0 {
+			return child.matchType&Exact != 0
 		}
 
-		if node.children[part].isEnd && i == len(parts)-1 {
-			return true // Match found due to wildcard
+		if child.matchType&Multiple != 0 {
+			return true
 		}
 
-		node = node.children[part]
+		node = child
+		end = start - 1
 
 	}
 
 	return false
 }
 
-// V6Search searches for a domain in the v6Trie
-func (t *TrieNode) V6Search(domain string) bool {
-	//todo: search时，node.isEND代表的是上一级的结果，当前层级的isEND应该在下一级展示,暂未研究是否可以优化insert
-
-	parts := strings.Split(domain, ":")
+// lookupMeta 查找命中规则的元数据，多条规则命中时取最具体的一条，
+// 普通规则均未命中时取第一条命中的正则/通配符规则
+func (t *TrieNode) lookupMeta(domain string) *ruleMeta {
+	domain = normalizeDomain(domain)
+	var meta *ruleMeta
+	matched := false
 	node := t
 
-	for i, part := range parts {
-
-		//fmt.Printf("i:%d, Search for: %s, isEnd: %v, MatchType: %v\n", i, part, node.isEnd, node.matchType)
-		//if _, ok := node.children[part]; ok {
-		//	fmt.Println(node.children[part].children)
-		//}
-
-		if node.children == nil {
-			return false
-		}
-		if _, ok := node.children[part]; !ok {
-			return false
+	for end := len(domain); end >= 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		child, ok := node.children[domain[start:end]]
+		if !ok {
+			break
 		}
 
-		//如果下一级存在*的匹配，立即返回true
-		if _, ok := node.children[part].children["*"]; ok {
-			return true
+		if start == 0 {
+			if child.matchType&Exact != 0 {
+				meta, matched = child.exactMeta, true
+			}
+			break
 		}
-
-		if node.children[part].isEnd && i == len(parts)-1 {
-			return true // Match found due to wildcard
+		if child.matchType&Multiple != 0 {
+			meta, matched = child.multipleMeta, true
 		}
 
-		node = node.children[part]
-
+		node = child
+		end = start - 1
 	}
 
-	return false
+	if !matched && t.patterns != nil {
+		return t.patterns.lookupMeta(domain)
+	}
+	return meta
 }
 
 // Traverse 方法遍历 Trie 并打印所有域名
@@ -165,45 +204,6 @@ func splitDomain(domain string) []string {
 	return parts
 }
 
-// V6ListToTree 读取文件中的 IPv6 地址并构建 Trie 树
-func V6ListToTree(filenames []string) *TrieNode {
-	counter := 0
-	trie := NewTrieNode()
-
-	if len(filenames) == 0 {
-		return trie
-	}
-
-	for _, file := range filenames {
-		// 打开文件
-		fileHandle, err := os.Open(file)
-		if err != nil {
-			fmt.Printf("Error opening file %s: %v\n", file, err)
-			continue
-		}
-		defer fileHandle.Close() // 确保文件句柄被正确关闭
-
-		// 扫描文件内容
-		scanner := bufio.NewScanner(fileHandle)
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" {
-				continue // 跳过空行
-			}
-			trie.v6Insert(line)
-			counter++
-		}
-
-		// 检查扫描错误
-		if err := scanner.Err(); err != nil {
-			fmt.Printf("Error reading file %s: %v\n", file, err)
-		}
-	}
-
-	fmt.Printf("Read %d IPv6 rules from files: %s\n", counter, strings.Join(filenames, ", "))
-
-	return trie
-}
 func treeTest() {
 	tree := NewTrieNode()
 
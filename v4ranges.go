@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// ipv4Range IPv4 闭区间
+type ipv4Range struct {
+	start uint32
+	end   uint32
+}
+
+// IPv4Ranges IPv4 规则，单个地址、CIDR 和范围都按整数区间存储，
+// 加载完成后排序合并，查找时二分，不再把网段展开为单个地址
+type IPv4Ranges struct {
+	ranges []ipv4Range
+
+	// 带元数据的规则按 IPv4 映射地址存入前缀树，仅在输出元数据时查找
+	metas *Trie
+}
+
+// NewIPv4Ranges 创建空的 IPv4 规则集
+func NewIPv4Ranges() *IPv4Ranges {
+	return &IPv4Ranges{}
+}
+
+// InsertRule 插入一行 IPv4 规则，语法与 ip.txt 一致：
+//
+//	192.168.0.1                 单个地址
+//	192.168.0.1/24              CIDR，主机位不为 0 时按网络地址处理
+//	192.168.1.1-192.168.1.2     范围
+//
+// 插入后需调用 Compact 才能查找
+func (s *IPv4Ranges) InsertRule(rule string) error {
+	return s.InsertRuleMeta(rule, nil)
+}
+
+// InsertRuleMeta 插入规则及其元数据
+func (s *IPv4Ranges) InsertRuleMeta(rule string, meta *ruleMeta) error {
+	n := len(s.ranges)
+	if err := s.insertRule(rule); err != nil {
+		return err
+	}
+	if meta != nil {
+		if s.metas == nil {
+			s.metas = NewTrie()
+		}
+		r := s.ranges[n]
+		s.metas.insertRange(s.metas.root, netip.PrefixFrom(netip.IPv6Unspecified(), 0), v4Mapped(r.start), v4Mapped(r.end), meta)
+	}
+	return nil
+}
+
+func (s *IPv4Ranges) insertRule(rule string) error {
+	if start, end, ok := strings.Cut(rule, "-"); ok {
+		first, err := parseV4(strings.TrimSpace(start))
+		if err != nil {
+			return err
+		}
+		last, err := parseV4(strings.TrimSpace(end))
+		if err != nil {
+			return err
+		}
+		if last < first {
+			return fmt.Errorf("invalid range %s: start is greater than end", rule)
+		}
+		s.ranges = append(s.ranges, ipv4Range{first, last})
+		return nil
+	}
+
+	if strings.Contains(rule, "/") {
+		prefix, err := netip.ParsePrefix(rule)
+		if err != nil {
+			return err
+		}
+		if !prefix.Addr().Is4() {
+			return fmt.Errorf("%s is not an IPv4 prefix", rule)
+		}
+		first := v4ToUint32(prefix.Masked().Addr())
+		last := first | uint32(uint64(1)<<(32-prefix.Bits())-1)
+		s.ranges = append(s.ranges, ipv4Range{first, last})
+		return nil
+	}
+
+	ip, err := parseV4(rule)
+	if err != nil {
+		return err
+	}
+	s.ranges = append(s.ranges, ipv4Range{ip, ip})
+	return nil
+}
+
+// Compact 排序并合并重叠或相邻的区间
+func (s *IPv4Ranges) Compact() {
+	if len(s.ranges) == 0 {
+		return
+	}
+	sort.Slice(s.ranges, func(i, j int) bool {
+		return s.ranges[i].start < s.ranges[j].start
+	})
+
+	merged := s.ranges[:1]
+	for _, r := range s.ranges[1:] {
+		last := &merged[len(merged)-1]
+		// 重叠或紧邻（r.start > last.end 时 r.start-1 不会溢出）
+		if r.start <= last.end || r.start-1 == last.end {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	s.ranges = merged
+}
+
+// Len 合并后的区间数
+func (s *IPv4Ranges) Len() int {
+	return len(s.ranges)
+}
+
+// Contains 地址是否落在任意区间内
+func (s *IPv4Ranges) Contains(ip uint32) bool {
+	// 找到第一个 end >= ip 的区间
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].end >= ip
+	})
+	return i < len(s.ranges) && s.ranges[i].start <= ip
+}
+
+// Search 查找字符串形式的地址，非 IPv4 地址返回 false
+func (s *IPv4Ranges) Search(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return false
+	}
+	return s.Contains(v4ToUint32(addr))
+}
+
+// lookupMeta 最长前缀匹配的规则元数据
+func (s *IPv4Ranges) lookupMeta(ip string) *ruleMeta {
+	if s.metas == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return nil
+	}
+	return s.metas.lookupMeta(netip.AddrFrom16(addr.As16()))
+}
+
+// v4Mapped 转换为 IPv4 映射的 IPv6 地址（::ffff:a.b.c.d）
+func v4Mapped(ip uint32) netip.Addr {
+	return netip.AddrFrom16(netip.AddrFrom4([4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}).As16())
+}
+
+// parseV4 解析单个 IPv4 地址
+func parseV4(s string) (uint32, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return 0, err
+	}
+	if !addr.Is4() {
+		return 0, fmt.Errorf("%s is not an IPv4 address", s)
+	}
+	return v4ToUint32(addr), nil
+}
+
+func v4ToUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"math/big"
-	"net"
-	"os"
+	"net/netip"
+	"strings"
 )
 
 // ipv6TrieNode节点定义
 type ipv6TrieNode struct {
 	children [2]*ipv6TrieNode
-	isEnd    bool // 标记是否是地址段末尾
+	isEnd    bool      // 标记是否是地址段末尾
+	meta     *ruleMeta // 规则元数据
 }
 
-// Trie定义
+// Trie IPv6 二进制前缀树，按地址的 128 位逐位存储，
+// 与地址的书写方式（压缩、补零、大小写）无关
 type Trie struct {
 	root *ipv6TrieNode
 }
@@ -24,108 +24,176 @@ func NewTrie() *Trie {
 	return &Trie{root: &ipv6TrieNode{}}
 }
 
-// 将IPv6地址字符串转换为*big.Int
-func ipv6ToBigInt(ip string) *big.Int {
-	parsedIP := net.ParseIP(ip).To16()
-	return big.NewInt(0).SetBytes(parsedIP)
+// InsertRule 插入一行 IPv6 规则，支持：
+//
+//	2409:8720::1                单个地址
+//	2409:8720:0C01:2A::/64      CIDR，主机位不为 0 时按网络地址处理
+//	2409:8720::1-2409:8720::3   任意范围，拆分为覆盖该范围的最少前缀
+func (t *Trie) InsertRule(rule string) error {
+	return t.InsertRuleMeta(rule, nil)
 }
 
-// 找出两个IPv6地址的公共前缀长度（通过异或找不同）
-func findCommonPrefixLength(start, end *big.Int) int {
-	xor := big.NewInt(0).Xor(start, end) // 对起始和结束IP进行异或操作
-	bits := xor.BitLen()                 // 获取异或结果中最左边1的位置
-	return 128 - bits                    // 公共前缀的长度
+// InsertRuleMeta 插入规则及其元数据
+func (t *Trie) InsertRuleMeta(rule string, meta *ruleMeta) error {
+	if start, end, ok := strings.Cut(rule, "-"); ok {
+		return t.insertRangeMeta(strings.TrimSpace(start), strings.TrimSpace(end), meta)
+	}
+
+	if strings.Contains(rule, "/") {
+		prefix, err := netip.ParsePrefix(rule)
+		if err != nil {
+			return err
+		}
+		if !prefix.Addr().Is6() {
+			return fmt.Errorf("%s is not an IPv6 prefix", rule)
+		}
+		t.insertPrefix(prefix.Masked(), meta)
+		return nil
+	}
+
+	addr, err := parseV6(rule)
+	if err != nil {
+		return err
+	}
+	t.insertPrefix(netip.PrefixFrom(addr, 128), meta)
+	return nil
+}
+
+// 插入IPv6范围
+func (t *Trie) InsertRange(startIP, endIP string) error {
+	return t.insertRangeMeta(startIP, endIP, nil)
+}
+
+func (t *Trie) insertRangeMeta(startIP, endIP string, meta *ruleMeta) error {
+	start, err := parseV6(startIP)
+	if err != nil {
+		return err
+	}
+	end, err := parseV6(endIP)
+	if err != nil {
+		return err
+	}
+	if end.Less(start) {
+		return fmt.Errorf("invalid range %s-%s: start is greater than end", startIP, endIP)
+	}
+
+	t.insertRange(t.root, netip.PrefixFrom(netip.IPv6Unspecified(), 0), start, end, meta)
+	return nil
 }
 
-// 将前缀长度转换为二进制表示
-func getPrefixBinary(ip *big.Int, prefixLength int) string {
-	// 将IP转换为二进制表示的字符串，并截取前缀部分
-	binaryStr := fmt.Sprintf("%0128b", ip)
-	return binaryStr[:prefixLength]
+// insertRange 自顶向下拆分范围：节点对应的前缀完全落在范围内时标记为末尾，
+// 部分重叠时继续向两个子节点拆分，与范围不相交的分支不会创建
+func (t *Trie) insertRange(node *ipv6TrieNode, prefix netip.Prefix, start, end netip.Addr, meta *ruleMeta) {
+	first, last := prefix.Addr(), lastAddr(prefix)
+	if !first.Less(start) && !end.Less(last) {
+		node.mark(meta)
+		return
+	}
+
+	for bit := 0; bit < 2; bit++ {
+		child := childPrefix(prefix, bit)
+		if end.Less(child.Addr()) || lastAddr(child).Less(start) {
+			continue
+		}
+		if node.children[bit] == nil {
+			node.children[bit] = &ipv6TrieNode{}
+		}
+		t.insertRange(node.children[bit], child, start, end, meta)
+	}
 }
 
-// 插入IPv6地址的二进制表示
-func (t *Trie) insertBinary(binaryIP string) {
+// insertPrefix 插入前缀的前 Bits() 位
+func (t *Trie) insertPrefix(prefix netip.Prefix, meta *ruleMeta) {
+	ip := prefix.Addr().As16()
 	node := t.root
-	for i := 0; i < len(binaryIP); i++ {
-		bit := int(binaryIP[i] - '0') // 获取当前位
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
 		if node.children[bit] == nil {
 			node.children[bit] = &ipv6TrieNode{}
 		}
 		node = node.children[bit]
 	}
-	node.isEnd = true // 标记地址段的末尾
+	node.mark(meta) // 标记地址段的末尾
 }
 
-// 插入IPv6范围
-func (t *Trie) InsertRange(startIP, endIP string) error {
-	start := ipv6ToBigInt(startIP)
-	end := ipv6ToBigInt(endIP)
-	prefixLength := findCommonPrefixLength(start, end)
-	prefixBinary := getPrefixBinary(start, prefixLength)
-
-	// 插入公共前缀的二进制表示
-	t.insertBinary(prefixBinary)
-	return nil
+// mark 标记地址段末尾，同一地址段的多条规则保留第一条的元数据
+func (n *ipv6TrieNode) mark(meta *ruleMeta) {
+	n.isEnd = true
+	if n.meta == nil {
+		n.meta = meta
+	}
 }
 
-// Search 查找IPv6地址是否在Trie中
+// Search 查找IPv6地址是否在Trie中，地址非法时返回 false
 func (t *Trie) Search(ip string) bool {
-	binaryIP := fmt.Sprintf("%0128b", ipv6ToBigInt(ip))
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return t.Contains(addr)
+}
+
+// Contains 地址是否落在任意一条规则内
+func (t *Trie) Contains(addr netip.Addr) bool {
+	ip := addr.As16()
 	node := t.root
-	for i := 0; i < len(binaryIP); i++ {
-		bit := int(binaryIP[i] - '0')
-		if node.children[bit] == nil {
-			return false
-		}
-		node = node.children[bit]
+	for i := 0; i < 128; i++ {
 		if node.isEnd {
 			return true // 匹配成功
 		}
+		node = node.children[ip[i/8]>>(7-i%8)&1]
+		if node == nil {
+			return false
+		}
 	}
-	return false
+	return node.isEnd
 }
 
-func ipV6ListToTree(filename []string) *TrieNode {
-	counter := 0
-	var files string
-
-	trie := NewTrieNode()
-
-	// Insert domains into the v6Trie
-
-	for _, file := range filename {
-		files = files + "/" + file
-
-		File, err := os.Open(file)
-		if err != nil {
-			fmt.Println(err)
+// lookupMeta 最长前缀匹配的规则元数据
+func (t *Trie) lookupMeta(addr netip.Addr) *ruleMeta {
+	ip := addr.As16()
+	node := t.root
+	var meta *ruleMeta
+	for i := 0; ; i++ {
+		if node.isEnd && node.meta != nil {
+			meta = node.meta
 		}
-
-		scanner := bufio.NewScanner(File)
-		for scanner.Scan() {
-			if scanner.Text() == "" {
-				continue
-			}
-			trie.Insert(scanner.Text())
-			counter++
+		if i == 128 {
+			return meta
+		}
+		if node = node.children[ip[i/8]>>(7-i%8)&1]; node == nil {
+			return meta
 		}
-
-		File.Close()
 	}
-	fmt.Printf("%s read %d domain rules\n", files, counter)
+}
 
-	return trie
+// parseV6 解析单个 IPv6 地址
+func parseV6(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return addr, err
+	}
+	if !addr.Is6() {
+		return addr, fmt.Errorf("%s is not an IPv6 address", s)
+	}
+	return addr.WithZone(""), nil
 }
 
-func test() {
-	trie := NewTrie()
-	// 插入IP范围
-	trie.InsertRange("2409:8720:2000:0000:0000:0000:0000:0000", "2409:8720:2000:0000:FFFF:FFFF:FFFF:FFFF")
-	trie.InsertRange("2409:8720:2001:0000:0000:0000:0000:0000", "2409:8720:2001:0000:FFFF:FFFF:FFFF:FFFF")
-	trie.InsertRange("2409:8720:2002:0000:0000:0000:0000:0000", "2409:8720:2002:0000:FFFF:FFFF:FFFF:FFFF")
+// childPrefix 前缀的下一位取 bit 得到的子前缀
+func childPrefix(prefix netip.Prefix, bit int) netip.Prefix {
+	ip := prefix.Addr().As16()
+	i := prefix.Bits()
+	if bit == 1 {
+		ip[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(ip), i+1)
+}
 
-	fmt.Println(trie.Search("2409:8720:2000:0000:0000:0000:0000:0001")) // 输出 true
-	fmt.Println(trie.Search("2409:8720:2001:0000:FFFF:FFFF:FFFF:FFFF")) // 输出 true
-	fmt.Println(trie.Search("2409:8720:2003:0000:0000:0000:0000:0000")) // 输出 false
+// lastAddr 前缀范围内的最后一个地址
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	ip := prefix.Addr().As16()
+	for i := prefix.Bits(); i < 128; i++ {
+		ip[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.AddrFrom16(ip)
 }
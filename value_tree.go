@@ -1,145 +1,59 @@
 package main
 
 import (
-	"fmt"
-	"strconv"
 	"strings"
 )
 
-// ValueTrieNode represents a node in the v6Trie
+// ValueTrieNode 组合索引的域名树，多个规则集的域名树合并为一棵，
+// 节点上记录精确匹配和子域名匹配该域名的规则集编号，一次查找得到所有命中的规则集
 type ValueTrieNode struct {
-	children  map[string]*ValueTrieNode
-	isEnd     bool // isEnd marks the end of a domain
-	matchType byte
-	value     []int
+	children map[string]*ValueTrieNode
+	exact    ruleSetBits // 精确匹配该域名的规则集
+	multiple ruleSetBits // 匹配该域名子域名的规则集
 }
 
-// NewValueTrieNode New ValueTrieNode creates a new Trie node
+// NewValueTrieNode creates a new Trie node
 func NewValueTrieNode() *ValueTrieNode {
 	return &ValueTrieNode{children: make(map[string]*ValueTrieNode)}
 }
 
-// Insert inserts a domain into the v6Trie
-func (t *ValueTrieNode) Insert(key string, value int) {
-
-	var parts []string
-	if strings.Contains(key, ":") {
-		parts = strings.Split(key, ":")
-
-	} else {
-		parts = splitDomain(strings.TrimSuffix(key, "."))
-
-	}
-	node := t
-	for _, part := range parts {
-		if _, ok := node.children[part]; !ok {
-			node.children[part] = NewValueTrieNode()
-		}
-		node = node.children[part]
-	}
-
-	node.isEnd = true
-	node.value = append(node.value, value)
-}
-
-func (t *ValueTrieNode) print() {
-	printNode2(t)
-}
-
-func printNode2(node *ValueTrieNode) {
-	for nodeName, trieNode := range node.children {
-		fmt.Printf("NodeName: %s, Address: %p, isEND: %v,Value: %+v\n", nodeName, trieNode, trieNode.isEnd, trieNode)
-		printNode2(trieNode)
-	}
-}
-
-// Search SearchDomain Search searches for a domain in the v6Trie
-func (t *ValueTrieNode) Search(key string) (bool, []int) {
-
-	var parts []string
-	if strings.Contains(key, ":") {
-		parts = strings.Split(key, ":")
-
-	} else {
-		parts = splitDomain(strings.TrimSuffix(key, "."))
-
-	}
-	node := t
-
-	for i, part := range parts {
-
-		//fmt.Printf("i:%d, Search for: %s, isEnd: %v, MatchType: %v\n", i, part, node.isEnd, node.matchType)
-		//if _, ok := node.children[part]; ok {
-		//	fmt.Println(node.children[part].children)
-		//}
-
-		if _, ok := node.children[part]; !ok {
-			return false, nil
+// merge 将一个规则集的域名树合入，bit 为该规则集的编号
+func (t *ValueTrieNode) merge(src *TrieNode, bit ruleSetBits) {
+	for part, child := range src.children {
+		node, ok := t.children[part]
+		if !ok {
+			node = NewValueTrieNode()
+			t.children[part] = node
 		}
-
-		//如果下一级存在*的匹配，立即返回true
-		if _, ok := node.children[part].children["*"]; ok {
-			return true, node.children[part].children["*"].value
+		if child.matchType&Exact != 0 {
+			node.exact |= bit
 		}
-
-		if node.children[part].isEnd && i == len(parts)-1 {
-			return true, node.children[part].value // Match found due to wildcard
+		if child.matchType&Multiple != 0 {
+			node.multiple |= bit
 		}
-
-		node = node.children[part]
-
+		node.merge(child, bit)
 	}
-
-	return false, nil
 }
 
-// Traverse 方法遍历 Trie 并打印所有域名
-func (t *ValueTrieNode) Traverse(parts []string) {
+// Search 返回命中域名的规则集，匹配规则与 TrieNode.searchLabels 一致：
+// 经过的节点上子域名匹配的规则集在还有剩余 label 时命中，最后一个 label 取精确匹配的规则集
+func (t *ValueTrieNode) Search(domain string) ruleSetBits {
+	var hits ruleSetBits
+	node := t
+	for end := len(domain); end >= 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
 
-	var result strings.Builder
-	if t.isEnd {
-		// 逆序输出 parts 切片以还原域名的正常顺序
-		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
-			parts[i], parts[j] = parts[j], parts[i]
+		child, ok := node.children[domain[start:end]]
+		if !ok {
+			return hits
 		}
-		result.WriteString(strings.Join(parts, ".") + "\n")
-
-	}
-	for part, child := range t.children {
-		child.Traverse(append([]string{part}, parts...))
-	}
-
-	//write(result.String())
-
-}
-
-func expandGenerate(generate string) []string {
-	// Split the $GENERATE directive
-	parts := strings.Fields(generate)
-	if len(parts) < 3 {
-		fmt.Println("Invalid format:", generate)
-		return nil
-	}
-
-	// Parse the range
-	rangeParts := strings.Split(parts[1], "-")
-	if len(rangeParts) != 2 {
-		fmt.Println("Invalid range:", parts[1])
-		return nil
-	}
-
-	start, err1 := strconv.Atoi(rangeParts[0])
-	end, err2 := strconv.Atoi(rangeParts[1])
-	if err1 != nil || err2 != nil {
-		fmt.Println("Invalid range numbers:", rangeParts)
-		return nil
-	}
+		if start == 0 {
+			return hits | child.exact
+		}
+		hits |= child.multiple
 
-	// Generate the domain names
-	template := parts[2]
-	var result []string
-	for i := start; i <= end; i++ {
-		result = append(result, strings.Replace(template, "$", strconv.Itoa(i), 1))
+		node = child
+		end = start - 1
 	}
-	return result
+	return hits
 }
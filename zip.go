@@ -14,6 +14,9 @@ import (
 	"sync"
 )
 
+// gzipWriterPool 复用 gzip 写入器，避免每次写文件都重新分配压缩字典
+var gzipWriterPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
 func IsGzipFile(filename string) bool {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -121,7 +124,9 @@ func (T *Tasks) WriteGzLog(outFilePath string, resultBuffer *bytes.Buffer) {
 	//defer L.FileLock.Unlock()
 
 	// 创建Gzip写入器，并将其与缓冲区关联
-	gzipWriter := gzip.NewWriter(file)
+	gzipWriter := gzipWriterPool.Get().(*gzip.Writer)
+	gzipWriter.Reset(file)
+	defer gzipWriterPool.Put(gzipWriter)
 	defer gzipWriter.Close()
 
 	// 将内容写入缓冲区
@@ -216,7 +221,7 @@ func (T *Tasks) deleteFile(filePath string) error {
 	return nil
 }
 
-func saveMap(map1 sync.Map, outFilePath string) {
+func saveMap(map1 *sync.Map, outFilePath string) {
 	var result strings.Builder
 
 	map1.Range(func(key, value any) bool {
@@ -242,7 +247,7 @@ func saveMap(map1 sync.Map, outFilePath string) {
 	fmt.Printf("[save] write domain list to %s\n", outFilePath)
 }
 
-func sortByValueAndSaveMap(map1 sync.Map, outFilePath string) {
+func sortByValueAndSaveMap(map1 *sync.Map, outFilePath string) {
 	var result strings.Builder
 	var entries []struct {
 		Key   string